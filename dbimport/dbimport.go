@@ -0,0 +1,631 @@
+// Package dbimport stores the records extracted from wiki pages in a database.
+package dbimport
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+type dbentry struct {
+	id         int
+	titleText  string
+	titleUrl   string
+	authorName string
+	authorUrl  string
+	date       time.Time
+	emoji      string
+	coverImage string
+}
+
+type dbkey map[string]int
+
+type dbvalue struct {
+	entryId int
+	keyId   int
+	data    string
+}
+
+// entryGen assigns the ids of entries, reusing the ids of the pages already
+// stored, by URL, so that a page imported again keeps its id.
+type entryGen struct {
+	ids    map[string]int
+	nextID int
+}
+
+// loadEntries returns an entryGen knowing the entries stored in db by
+// previous imports.
+func loadEntries(db *sql.DB, d *dialect, table string) (*entryGen, error) {
+	g := &entryGen{ids: make(map[string]int), nextID: 1}
+	rows, err := db.Query(fmt.Sprintf("SELECT id, title_url FROM %s", d.ident(table)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query entries: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id  int
+			url sql.NullString
+		)
+		if err := rows.Scan(&id, &url); err != nil {
+			return nil, fmt.Errorf("cannot read entry: %s", err)
+		}
+		if url.String != "" {
+			g.ids[url.String] = id
+		}
+		if id >= g.nextID {
+			g.nextID = id + 1
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read entries: %s", err)
+	}
+	return g, nil
+}
+
+func (g *entryGen) generate(data map[string]interface{}) *dbentry {
+	e := g.parse(data, g.nextID)
+	if id, ok := g.ids[e.titleUrl]; ok && e.titleUrl != "" {
+		e.id = id
+		return e
+	}
+	if e.titleUrl != "" {
+		g.ids[e.titleUrl] = e.id
+	}
+	g.nextID++
+	return e
+}
+
+func (g *entryGen) parse(data map[string]interface{}, id int) *dbentry {
+	e := &dbentry{id: id}
+	author, ok := data["_author"].(map[string]interface{})
+	if ok {
+		e.authorName = author["name"].(string)
+		e.authorUrl = author["url"].(string)
+	}
+	title, ok := data["_title"].(map[string]interface{})
+	if ok {
+		e.titleText = title["text"].(string)
+		e.titleUrl = title["url"].(string)
+	}
+	if emoji, ok := data["_emoji"].(string); ok {
+		e.emoji = emoji
+	}
+	if cover, ok := data["_cover_image"].(string); ok {
+		e.coverImage = cover
+	}
+	if d, ok := data["_date"].(string); ok {
+		// Silently ignore invalid dates
+		if date, err := time.Parse(time.RFC3339, d); err == nil {
+			e.date = date
+		}
+	}
+	return e
+}
+
+// KeyPolicy canonicalizes table keys and keeps track of how often they are used.
+type KeyPolicy struct {
+	// Maps synonyms to their canonical key
+	mapping map[string]string
+	// Canonical keys, the targets of mapping
+	known map[string]struct{}
+	// Drop keys that are not known
+	strict bool
+	uses   map[string]int
+}
+
+// NewKeyPolicy returns a KeyPolicy mapping the synonyms in the JSON object in
+// filename, if set, to their canonical key. With strict, other keys are dropped.
+func NewKeyPolicy(filename string, strict bool) (*KeyPolicy, error) {
+	p := &KeyPolicy{
+		mapping: make(map[string]string),
+		known:   make(map[string]struct{}),
+		strict:  strict,
+		uses:    make(map[string]int),
+	}
+	if filename == "" {
+		if strict {
+			return nil, errors.New("a key mapping is required to only accept known keys")
+		}
+		return p, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key mapping: %s", err)
+	}
+	if err := json.Unmarshal(data, &p.mapping); err != nil {
+		return nil, fmt.Errorf("cannot parse key mapping: %s", err)
+	}
+	for _, c := range p.mapping {
+		p.known[c] = struct{}{}
+	}
+	return p, nil
+}
+
+// canonical returns the key to store for key, or false if the key must be dropped.
+func (p *KeyPolicy) canonical(key string) (string, bool) {
+	if c, ok := p.mapping[key]; ok {
+		key = c
+	} else if _, ok := p.known[key]; !ok && p.strict {
+		return "", false
+	}
+	p.uses[key]++
+	return key, true
+}
+
+// Report warns when more than max distinct keys were used, listing the one-off keys.
+func (p *KeyPolicy) Report(max int) {
+	if max <= 0 || len(p.uses) <= max {
+		return
+	}
+	var rare []string
+	for k, n := range p.uses {
+		if n == 1 {
+			rare = append(rare, k)
+		}
+	}
+	sort.Strings(rare)
+	log.Printf("warning: %d distinct keys exceed the limit of %d; %d keys are used only once: %s",
+		len(p.uses), max, len(rare), strings.Join(rare, ", "))
+}
+
+// keyGen assigns the ids of keys, reusing the ids of the keys already stored.
+type keyGen struct {
+	ids    dbkey
+	nextID int
+}
+
+// loadKeys returns a keyGen knowing the keys stored in db by previous imports.
+func loadKeys(db *sql.DB, d *dialect, table string) (*keyGen, error) {
+	g := &keyGen{ids: dbkey(make(map[string]int)), nextID: 1}
+	rows, err := db.Query(fmt.Sprintf("SELECT id, name FROM %s", d.ident(table)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query keys: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id   int
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("cannot read key: %s", err)
+		}
+		g.ids[name] = id
+		if id >= g.nextID {
+			g.nextID = id + 1
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read keys: %s", err)
+	}
+	return g, nil
+}
+
+// addKeys returns the values in data and the keys they use that were not seen
+// before. The new keys must be stored before the values referencing them.
+func (g *keyGen) addKeys(entryId int, data map[string]interface{}, policy *KeyPolicy) (dbkey, dbvalues) {
+	added := dbkey(make(map[string]int))
+	vals := dbvalues(make([]*dbvalue, 0, len(data)))
+	seen := make(map[string]struct{})
+	for k := range data {
+		// Keys starting with an underscore are page metadata, not table fields
+		if strings.HasPrefix(k, "_") {
+			continue
+		}
+		key, ok := policy.canonical(strings.TrimSpace(k))
+		if !ok {
+			continue
+		}
+		// Synonyms of a key already in this record are dropped
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		id, ok := g.ids[key]
+		if !ok {
+			id = g.nextID
+			g.nextID++
+			g.ids[key] = id
+			added[key] = id
+		}
+		vals = append(vals, &dbvalue{
+			entryId: entryId,
+			keyId:   id,
+			data:    valueData(data[k]),
+		})
+	}
+	return added, vals
+}
+
+// valueData returns the text stored for a value: strings as they are, other
+// values, like the lists of list cells or nested tables, as JSON.
+func valueData(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("warning: cannot encode value: %s", err)
+		return ""
+	}
+	return string(data)
+}
+
+type dbvalues []*dbvalue
+
+type stmts struct {
+	entry *sql.Stmt
+	value *sql.Stmt
+	key   *sql.Stmt
+}
+
+// tx returns the statements to execute within tx.
+func (s *stmts) tx(tx *sql.Tx) *stmts {
+	return &stmts{
+		entry: tx.Stmt(s.entry),
+		value: tx.Stmt(s.value),
+		key:   tx.Stmt(s.key),
+	}
+}
+
+func (e *dbentry) store(s *stmts) error {
+	_, err := s.entry.Exec(e.id, e.titleText, e.titleUrl, e.authorName, e.authorUrl, e.date, e.emoji, e.coverImage)
+	if err != nil {
+		return fmt.Errorf("cannot store entry: %s", err)
+	}
+	return nil
+}
+
+func (vs dbvalues) store(s *stmts) error {
+	for i := range vs {
+		if vs[i] == nil {
+			return errors.New("cannot store value: value is nil")
+		}
+		_, err := s.value.Exec(vs[i].entryId, vs[i].keyId, vs[i].data)
+		if err != nil {
+			return fmt.Errorf("cannot store value: %s", err)
+		}
+	}
+	return nil
+}
+
+func (ks dbkey) store(s *stmts) error {
+	for k, id := range ks {
+		_, err := s.key.Exec(id, k)
+		if err != nil {
+			return fmt.Errorf("cannot store key: %s", err)
+		}
+	}
+	return nil
+}
+
+type storer interface {
+	store(s *stmts) error
+}
+
+// dbrecord is everything stored for one page, written in the same transaction.
+type dbrecord []storer
+
+func (r dbrecord) store(s *stmts) error {
+	for _, st := range r {
+		if err := st.store(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dbconn struct {
+	db *sql.DB
+	s  *stmts
+	// Number of records committed in each transaction
+	batch int
+}
+
+// start connects to the database and prepares the statements. The tables are
+// created first if initSchema is set or the driver always needs it. With
+// upsert, existing rows are updated instead of failing the import.
+func (c *dbconn) start(d *dialect, dsn string, t Tables, initSchema, upsert bool) error {
+	var err error
+	c.db, err = sql.Open(d.driver, dsn)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", d.driver, err)
+	}
+	if initSchema || d.createSchema {
+		if err := c.initSchema(d, t); err != nil {
+			return err
+		}
+	}
+	if err := c.migrate(d, t, upsert); err != nil {
+		return err
+	}
+	c.s = &stmts{}
+	insert := d.insert
+	if upsert {
+		insert = d.upsert
+	}
+	c.s.entry, err = c.db.Prepare(insert(t.Entries, 1, "id", "title_text", "title_url", "author_name", "author_url", "date", "emoji", "cover_image"))
+	if err != nil {
+		return fmt.Errorf("cannot prepare statement for table %s: %s", t.Entries, err)
+	}
+	c.s.value, err = c.db.Prepare(insert(t.Values, 2, "entry_id", "key_id", "data"))
+	if err != nil {
+		return fmt.Errorf("cannot prepare statement for table %s: %s", t.Values, err)
+	}
+	c.s.key, err = c.db.Prepare(insert(t.Keys, 1, "id", "name"))
+	if err != nil {
+		return fmt.Errorf("cannot prepare statement for table %s: %s", t.Keys, err)
+	}
+	return nil
+}
+
+// commit stores s in its own transaction.
+func (c *dbconn) commit(s storer) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot begin transaction: %s", err)
+	}
+	if err := s.store(c.s.tx(tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit: %s", err)
+	}
+	return nil
+}
+
+func (c *dbconn) initSchema(d *dialect, t Tables) error {
+	for _, q := range d.schema(t) {
+		if _, err := c.db.Exec(q); err != nil {
+			return fmt.Errorf("cannot create table: %s", err)
+		}
+	}
+	return nil
+}
+
+// migrate adds the columns missing from the tables of older versions. The
+// values table of those has no primary key to update rows on, so it cannot
+// be used with upsert.
+func (c *dbconn) migrate(d *dialect, t Tables, upsert bool) error {
+	for _, col := range addedColumns {
+		table := col.table(t)
+		rows, err := c.db.Query(fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0", col.name, d.ident(table)))
+		if err == nil {
+			rows.Close()
+			continue
+		}
+		if table == t.Values && upsert {
+			return fmt.Errorf("table %s was created by an older version without column %s: drop it or import without upsert", table, col.name)
+		}
+		log.Printf("info: adding column %s to table %s", col.name, table)
+		q := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", d.ident(table), col.name, col.typ)
+		if _, err := c.db.Exec(q); err != nil {
+			return fmt.Errorf("cannot add column %s to table %s: %s", col.name, table, err)
+		}
+	}
+	return nil
+}
+
+// store writes the records received from in, committing every c.batch records,
+// until in is closed or stop is. After the first error the current transaction
+// is rolled back and the error is returned. Multiple stores can run
+// concurrently on the same connection pool, each with its own transaction.
+func (c *dbconn) store(in <-chan dbrecord, stop <-chan struct{}) error {
+	var (
+		tx *sql.Tx
+		ts *stmts
+		n  int
+	)
+	for {
+		var (
+			rec dbrecord
+			ok  bool
+		)
+		select {
+		case rec, ok = <-in:
+		case <-stop:
+		}
+		if !ok {
+			break
+		}
+		if tx == nil {
+			var err error
+			if tx, err = c.db.Begin(); err != nil {
+				return fmt.Errorf("cannot begin transaction: %s", err)
+			}
+			ts = c.s.tx(tx)
+		}
+		if err := rec.store(ts); err != nil {
+			tx.Rollback()
+			return err
+		}
+		n++
+		if n >= c.batch {
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("cannot commit: %s", err)
+			}
+			tx, n = nil, 0
+		}
+	}
+	if tx == nil {
+		return nil
+	}
+	// Records stored before another worker failed are kept
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit: %s", err)
+	}
+	return nil
+}
+
+// Tables are the names of the tables records are stored in.
+type Tables struct {
+	Entries string
+	Values  string
+	Keys    string
+}
+
+// DefaultTables are the tables used when Options.Tables is not set.
+var DefaultTables = Tables{Entries: "entries", Values: "values", Keys: "keys"}
+
+// Options configure an Importer.
+type Options struct {
+	// Database driver: mysql, postgres or sqlite
+	Driver string
+	DSN    string
+	// Number of records committed in each transaction
+	Batch int
+	// Number of connections writing records in parallel
+	Workers int
+	// Update rows already imported instead of failing
+	Upsert bool
+	// Create the tables if they do not exist
+	InitSchema bool
+	// Policy for the keys of the tables, all kept if nil
+	Policy *KeyPolicy
+	// Names of the tables, DefaultTables if zero
+	Tables Tables
+}
+
+// Importer stores records in a database in the background.
+type Importer struct {
+	conn    *dbconn
+	policy  *KeyPolicy
+	entries *entryGen
+	keys    *keyGen
+	records chan dbrecord
+	done    chan error
+	workers int
+	// Closed with the first error of a worker, stored in err
+	failed   chan struct{}
+	failOnce sync.Once
+	err      error
+}
+
+// Open connects to the database and starts the workers storing records.
+func Open(opts Options) (*Importer, error) {
+	d, err := newDialect(opts.Driver)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Batch < 1 {
+		return nil, errors.New("batch size must be at least one")
+	}
+	if opts.Workers < 1 {
+		return nil, errors.New("at least one DB worker is required")
+	}
+	if opts.Workers > 1 && d.singleWriter {
+		log.Printf("warning: %s supports a single writer, using one DB worker", d.driver)
+		opts.Workers = 1
+	}
+	if opts.Tables == (Tables{}) {
+		opts.Tables = DefaultTables
+	}
+	if opts.Tables.Entries == "" || opts.Tables.Values == "" || opts.Tables.Keys == "" {
+		return nil, errors.New("all table names are required")
+	}
+	policy := opts.Policy
+	if policy == nil {
+		if policy, err = NewKeyPolicy("", false); err != nil {
+			return nil, err
+		}
+	}
+	conn := &dbconn{batch: opts.Batch}
+	if err := conn.start(d, opts.DSN, opts.Tables, opts.InitSchema, opts.Upsert); err != nil {
+		return nil, fmt.Errorf("cannot start DB: %s", err)
+	}
+	// One more connection than workers to store the new keys
+	conn.db.SetMaxOpenConns(opts.Workers + 1)
+	entries, err := loadEntries(conn.db, d, opts.Tables.Entries)
+	if err != nil {
+		conn.db.Close()
+		return nil, err
+	}
+	keys, err := loadKeys(conn.db, d, opts.Tables.Keys)
+	if err != nil {
+		conn.db.Close()
+		return nil, err
+	}
+	im := &Importer{
+		conn:    conn,
+		policy:  policy,
+		entries: entries,
+		keys:    keys,
+		records: make(chan dbrecord, 100),
+		done:    make(chan error, opts.Workers),
+		workers: opts.Workers,
+		failed:  make(chan struct{}),
+	}
+	for i := 0; i < im.workers; i++ {
+		go func() {
+			err := conn.store(im.records, im.failed)
+			if err != nil {
+				im.fail(err)
+			}
+			im.done <- err
+		}()
+	}
+	return im, nil
+}
+
+// fail stops all the workers after the first error, which is reported by
+// ImportRecord and Close.
+func (im *Importer) fail(err error) {
+	im.failOnce.Do(func() {
+		im.err = err
+		close(im.failed)
+	})
+}
+
+// ImportRecord queues the record of a page for storage. The keys it uses
+// for the first time are stored before any value can reference them. After
+// the first error storing records, no more are stored and ImportRecord returns
+// that error. It must not be called concurrently.
+func (im *Importer) ImportRecord(data map[string]interface{}) error {
+	// Ids are assigned here, so that they don't depend on the workers
+	entry := im.entries.generate(data)
+	added, vals := im.keys.addKeys(entry.id, data, im.policy)
+	rec := dbrecord{entry}
+	if len(added) > 0 {
+		if im.workers == 1 {
+			// The only transaction stores the keys before the values
+			rec = append(rec, added)
+		} else if err := im.conn.commit(added); err != nil {
+			// Other workers might store values referencing the keys first
+			im.fail(err)
+			return err
+		}
+	}
+	select {
+	case im.records <- append(rec, vals):
+		return nil
+	case <-im.failed:
+		return im.err
+	}
+}
+
+// Close waits for the queued records to be stored and disconnects. It returns
+// the first error storing records.
+func (im *Importer) Close() error {
+	close(im.records)
+	for i := 0; i < im.workers; i++ {
+		<-im.done
+	}
+	im.conn.db.Close()
+	return im.err
+}
@@ -0,0 +1,291 @@
+package dbimport
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// record returns the record of a page with the given table keys and values.
+func record(title string, kv ...interface{}) map[string]interface{} {
+	data := map[string]interface{}{
+		"_title": map[string]interface{}{"text": title, "url": "http://wiki.local/display/X/" + title},
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		data[kv[i].(string)] = kv[i+1]
+	}
+	return data
+}
+
+func importAll(t *testing.T, opts Options, records ...map[string]interface{}) {
+	im, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := im.ImportRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportWorkers(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	var records []map[string]interface{}
+	for n := 0; n < 200; n++ {
+		// Shared keys and a key used by each page only
+		records = append(records, record(fmt.Sprintf("page%d", n),
+			"Owner", "team", "Status", "done", fmt.Sprintf("Field %d", n), "x"))
+	}
+	// No worker commits before the end, values of other workers can only
+	// reference keys committed apart
+	importAll(t, Options{Driver: "fake", DSN: dsn, Batch: 1000, Workers: 4}, records...)
+	if n := len(db.rows("entries")); n != 200 {
+		t.Errorf("got %d entries, want 200", n)
+	}
+	if n := len(db.rows("values")); n != 600 {
+		t.Errorf("got %d values, want 600", n)
+	}
+	if n := len(db.rows("keys")); n != 202 {
+		t.Errorf("got %d keys, want 202", n)
+	}
+}
+
+// valuesOf returns the data of the imported values by key name.
+func valuesOf(db *fakeDB) map[string]string {
+	names := make(map[string]string)
+	for _, k := range db.rows("keys") {
+		names[fmt.Sprint(k["id"])] = fmt.Sprint(k["name"])
+	}
+	vals := make(map[string]string)
+	for _, v := range db.rows("values") {
+		vals[names[fmt.Sprint(v["key_id"])]] = fmt.Sprint(v["data"])
+	}
+	return vals
+}
+
+// decode returns a record as read by the importer.
+func decode(t *testing.T, line string) map[string]interface{} {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestImportNestedValues(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	rec := decode(t, `{"_title": {"text": "Page", "url": "http://wiki.local/display/X/Page"},
+		"Owner": "team", "Contacts": {"Mail": "a@wiki.local", "Phone": "123"}}`)
+	importAll(t, Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1}, rec)
+	vals := valuesOf(db)
+	if vals["Owner"] != "team" {
+		t.Errorf("got Owner %q, want %q", vals["Owner"], "team")
+	}
+	if want := `{"Mail":"a@wiki.local","Phone":"123"}`; vals["Contacts"] != want {
+		t.Errorf("got Contacts %q, want %q", vals["Contacts"], want)
+	}
+}
+
+func TestImportListValues(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	// List cells as extracted, and as read back from JSON
+	importAll(t, Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1},
+		record("Page1", "Owners", []string{"alice", "bob"}),
+		decode(t, `{"_title": {"text": "Page2", "url": "http://wiki.local/display/X/Page2"},
+			"Reviewers": ["carol", "dave"]}`))
+	vals := valuesOf(db)
+	if want := `["alice","bob"]`; vals["Owners"] != want {
+		t.Errorf("got Owners %q, want %q", vals["Owners"], want)
+	}
+	if want := `["carol","dave"]`; vals["Reviewers"] != want {
+		t.Errorf("got Reviewers %q, want %q", vals["Reviewers"], want)
+	}
+}
+
+func TestImportAgain(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	opts := Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1}
+	importAll(t, opts, record("Page1", "Owner", "alice"), record("Page2", "Owner", "bob"))
+	// New pages continue after the entries of the first run
+	importAll(t, opts, record("Page3", "Owner", "carol"))
+	if n := len(db.rows("entries")); n != 3 {
+		t.Errorf("got %d entries, want 3", n)
+	}
+	// A page imported again keeps its entry
+	opts.Upsert = true
+	importAll(t, opts, record("Page1", "Owner", "dave"))
+	entries := db.rows("entries")
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	for _, e := range entries {
+		if e["title_text"] == "Page1" && fmt.Sprint(e["id"]) != "1" {
+			t.Errorf("got id %v for Page1, want 1", e["id"])
+		}
+	}
+	for _, v := range db.rows("values") {
+		if fmt.Sprint(v["entry_id"]) == "1" && v["data"] != "dave" {
+			t.Errorf("got Owner %v for Page1, want dave", v["data"])
+		}
+	}
+}
+
+func TestImportSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbimport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "wiki.db")
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pages.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		records = append(records, decode(t, line))
+	}
+	importAll(t, Options{Driver: "sqlite", DSN: dsn, Batch: 10, Workers: 1}, records...)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for table, want := range map[string]int{"entries": 2, "values": 4, "keys": 3} {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM "` + table + `"`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("got %d rows in %s, want %d", n, table, want)
+		}
+	}
+}
+
+func TestImportKeysBeforeValues(t *testing.T) {
+	// The fake database checks that values reference stored keys, like a
+	// foreign key on keys.id
+	for _, opts := range []Options{
+		{Batch: 1, Workers: 1},
+		{Batch: 10, Workers: 1},
+		{Batch: 1, Workers: 2},
+		{Batch: 10, Workers: 2},
+	} {
+		dsn, db := newFakeDB(t)
+		opts.Driver, opts.DSN = "fake", dsn
+		importAll(t, opts,
+			record("Page1", "Owner", "alice"),
+			record("Page2", "Owner", "bob", "Status", "done"),
+			record("Page3", "Status", "draft", "Reviewer", "carol"))
+		if n := len(db.rows("values")); n != 5 {
+			t.Errorf("batch %d, %d workers: got %d values, want 5", opts.Batch, opts.Workers, n)
+		}
+	}
+}
+
+func TestImportMigrate(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	// The entries table of an older version, without emoji and cover image
+	db.create("entries", []string{"id", "title_text", "title_url", "author_name", "author_url", "date"})
+	rec := record("Page", "Owner", "alice")
+	rec["_emoji"] = "1f680"
+	importAll(t, Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1}, rec)
+	entries := db.rows("entries")
+	if len(entries) != 1 || entries[0]["emoji"] != "1f680" {
+		t.Errorf("got entries %v, want one with its emoji", entries)
+	}
+}
+
+func TestImportMigrateValues(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	// The values table of an older version, without the entry of each value
+	db.create("values", []string{"key_id", "data"})
+	importAll(t, Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1}, record("Page", "Owner", "alice"))
+	values := db.rows("values")
+	if len(values) != 1 || values[0]["entry_id"] == nil {
+		t.Errorf("got values %v, want one with its entry", values)
+	}
+
+	// Without a primary key, upserts cannot find the rows to update
+	dsn, db = newFakeDB(t)
+	db.create("values", []string{"key_id", "data"})
+	_, err := Open(Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1, Upsert: true})
+	if err == nil || !strings.Contains(err.Error(), "entry_id") {
+		t.Errorf("got error %v, want one about the missing entry_id", err)
+	}
+}
+
+func TestImportStopsOnError(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	im, err := Open(Options{Driver: "fake", DSN: dsn, Batch: 1, Workers: 1, InitSchema: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same page twice fails without upsert, the records after it are
+	// not read any more
+	records := []map[string]interface{}{record("Page", "Owner", "alice"), record("Page", "Owner", "alice")}
+	for n := 0; n < 1000; n++ {
+		records = append(records, record(fmt.Sprintf("page%d", n), "Owner", "bob"))
+	}
+	var importErr error
+	for _, rec := range records {
+		if importErr = im.ImportRecord(rec); importErr != nil {
+			break
+		}
+	}
+	if importErr == nil {
+		t.Error("got no error importing records after a failure")
+	}
+	if err := im.Close(); err == nil || err != importErr {
+		t.Errorf("got error %v closing, want %v", err, importErr)
+	}
+	if n := len(db.rows("entries")); n == 0 || n > 200 {
+		t.Errorf("got %d entries, want the ones stored before the failure", n)
+	}
+}
+
+func TestImportBatch(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	var records []map[string]interface{}
+	for n := 0; n < 10; n++ {
+		records = append(records, record(fmt.Sprintf("page%d", n), "Owner", "team"))
+	}
+	importAll(t, Options{Driver: "fake", DSN: dsn, Batch: 4, Workers: 1}, records...)
+	if n := len(db.rows("entries")); n != 10 {
+		t.Errorf("got %d entries, want 10", n)
+	}
+	// Two full batches and the rest when closing
+	db.mux.Lock()
+	commits := db.commits
+	db.mux.Unlock()
+	if commits != 3 {
+		t.Errorf("got %d transactions, want 3", commits)
+	}
+}
+
+func TestImportTables(t *testing.T) {
+	dsn, db := newFakeDB(t)
+	db.keys = "wiki_keys"
+	tables := Tables{Entries: "wiki_entries", Values: "wiki_values", Keys: "wiki_keys"}
+	importAll(t, Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1, Tables: tables, InitSchema: true},
+		record("Page1", "Owner", "alice"), record("Page2", "Owner", "bob"))
+	for table, want := range map[string]int{"wiki_entries": 2, "wiki_values": 2, "wiki_keys": 1, "entries": 0} {
+		if n := len(db.rows(table)); n != want {
+			t.Errorf("got %d rows in %s, want %d", n, table, want)
+		}
+	}
+	// Names are all set or none
+	_, err := Open(Options{Driver: "fake", DSN: dsn, Batch: 10, Workers: 1, Tables: Tables{Entries: "wiki_entries"}})
+	if err == nil {
+		t.Error("got no error with the tables partly named")
+	}
+}
@@ -0,0 +1,122 @@
+package dbimport
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dialect hides the differences in SQL syntax between database drivers.
+type dialect struct {
+	driver string
+	// Quote character for identifiers
+	quote string
+	// Numbered placeholders like $1 instead of ?
+	numbered bool
+	// ON CONFLICT clauses instead of ON DUPLICATE KEY
+	onConflict bool
+	// Column type for dates
+	timestamp string
+	// Always create the tables when connecting
+	createSchema bool
+	// Only one connection can write at a time
+	singleWriter bool
+}
+
+var dialects = map[string]*dialect{
+	"mysql":    {driver: "mysql", quote: "`", timestamp: "DATETIME"},
+	"postgres": {driver: "postgres", quote: `"`, numbered: true, onConflict: true, timestamp: "TIMESTAMP"},
+	"sqlite":   {driver: "sqlite", quote: `"`, onConflict: true, timestamp: "DATETIME", createSchema: true, singleWriter: true},
+}
+
+func newDialect(name string) (*dialect, error) {
+	d, ok := dialects[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver: %s", name)
+	}
+	return d, nil
+}
+
+// ident quotes name, which can be qualified like schema.table.
+func (d *dialect) ident(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = d.quote + strings.Replace(p, d.quote, d.quote+d.quote, -1) + d.quote
+	}
+	return strings.Join(parts, ".")
+}
+
+// placeholders returns n comma separated placeholders.
+func (d *dialect) placeholders(n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		if d.numbered {
+			ps[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			ps[i] = "?"
+		}
+	}
+	return strings.Join(ps, ", ")
+}
+
+// insert returns the statement inserting columns into table. The first nkeys
+// columns are the primary key, see upsert.
+func (d *dialect) insert(table string, nkeys int, columns ...string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		d.ident(table), strings.Join(columns, ", "), d.placeholders(len(columns)))
+}
+
+// upsert returns the statement inserting columns into table, or updating the
+// row if one with the same values in the first nkeys columns exists.
+func (d *dialect) upsert(table string, nkeys int, columns ...string) string {
+	updates := make([]string, 0, len(columns)-nkeys)
+	for _, c := range columns[nkeys:] {
+		if d.onConflict {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", c, c))
+		} else {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", c, c))
+		}
+	}
+	q := d.insert(table, nkeys, columns...)
+	if d.onConflict {
+		return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s",
+			q, strings.Join(columns[:nkeys], ", "), strings.Join(updates, ", "))
+	}
+	return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", q, strings.Join(updates, ", "))
+}
+
+// addedColumns are the columns missing from the tables created by older
+// versions, with the table they belong to and their type.
+var addedColumns = []struct {
+	table     func(Tables) string
+	name, typ string
+}{
+	{func(t Tables) string { return t.Entries }, "emoji", "VARCHAR(64)"},
+	{func(t Tables) string { return t.Entries }, "cover_image", "TEXT"},
+	{func(t Tables) string { return t.Values }, "entry_id", "INT"},
+}
+
+// schema returns the statements creating the tables if they do not exist.
+func (d *dialect) schema(t Tables) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id INT PRIMARY KEY,
+	title_text VARCHAR(255),
+	title_url VARCHAR(1024),
+	author_name VARCHAR(255),
+	author_url VARCHAR(1024),
+	date %s,
+	emoji VARCHAR(64),
+	cover_image TEXT
+)`, d.ident(t.Entries), d.timestamp),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	entry_id INT,
+	key_id INT,
+	data TEXT,
+	PRIMARY KEY (entry_id, key_id)
+)`, d.ident(t.Values)),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id INT PRIMARY KEY,
+	name VARCHAR(255) UNIQUE
+)`, d.ident(t.Keys)),
+	}
+}
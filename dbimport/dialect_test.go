@@ -0,0 +1,76 @@
+package dbimport
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatements(t *testing.T) {
+	tests := []struct {
+		driver         string
+		insert, upsert string
+	}{
+		{"mysql",
+			"INSERT INTO `values` (entry_id, key_id, data) VALUES (?, ?, ?)",
+			"INSERT INTO `values` (entry_id, key_id, data) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)"},
+		{"postgres",
+			`INSERT INTO "values" (entry_id, key_id, data) VALUES ($1, $2, $3)`,
+			`INSERT INTO "values" (entry_id, key_id, data) VALUES ($1, $2, $3) ON CONFLICT (entry_id, key_id) DO UPDATE SET data = excluded.data`},
+		{"sqlite",
+			`INSERT INTO "values" (entry_id, key_id, data) VALUES (?, ?, ?)`,
+			`INSERT INTO "values" (entry_id, key_id, data) VALUES (?, ?, ?) ON CONFLICT (entry_id, key_id) DO UPDATE SET data = excluded.data`},
+	}
+	for _, tt := range tests {
+		d, err := newDialect(tt.driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.insert("values", 2, "entry_id", "key_id", "data"); got != tt.insert {
+			t.Errorf("%s insert:\ngot  %s\nwant %s", tt.driver, got, tt.insert)
+		}
+		if got := d.upsert("values", 2, "entry_id", "key_id", "data"); got != tt.upsert {
+			t.Errorf("%s upsert:\ngot  %s\nwant %s", tt.driver, got, tt.upsert)
+		}
+		for _, q := range d.schema(DefaultTables) {
+			if !strings.Contains(q, "CREATE TABLE IF NOT EXISTS "+d.quote) {
+				t.Errorf("%s schema: table name not quoted: %s", tt.driver, q)
+			}
+		}
+	}
+}
+
+func TestSchemaTables(t *testing.T) {
+	d, err := newDialect("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := Tables{Entries: "wiki.entries", Values: "wiki.values", Keys: "wiki.keys"}
+	want := []string{`"wiki"."entries"`, `"wiki"."values"`, `"wiki"."keys"`}
+	for n, q := range d.schema(tables) {
+		if !strings.HasPrefix(q, "CREATE TABLE IF NOT EXISTS "+want[n]+" (") {
+			t.Errorf("got %s, want table %s", q, want[n])
+		}
+	}
+	if got, want := d.insert(tables.Values, 2, "entry_id", "key_id", "data"), `INSERT INTO "wiki"."values" (entry_id, key_id, data) VALUES ($1, $2, $3)`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestIdent(t *testing.T) {
+	tests := []struct{ driver, name, want string }{
+		{"mysql", "keys", "`keys`"},
+		{"mysql", "wiki.keys", "`wiki`.`keys`"},
+		{"mysql", "odd`name", "`odd``name`"},
+		{"postgres", "public.values", `"public"."values"`},
+		{"postgres", `odd"name`, `"odd""name"`},
+	}
+	for _, tt := range tests {
+		d, err := newDialect(tt.driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.ident(tt.name); got != tt.want {
+			t.Errorf("%s ident(%q) = %s, want %s", tt.driver, tt.name, got, tt.want)
+		}
+	}
+}
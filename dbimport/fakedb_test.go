@@ -0,0 +1,317 @@
+package dbimport
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is an in-memory database for the tests, used through the "fake"
+// dialect. It understands the statements of the importer only. Inserts in a
+// transaction are seen by other connections once committed, and values must
+// reference a key visible to them, like with a foreign key on keys.id.
+type fakeDB struct {
+	mux    sync.Mutex
+	tables map[string]*fakeTable
+	// Table of the keys referenced by values
+	keys string
+	// Number of transactions committed
+	commits int
+}
+
+type fakeTable struct {
+	cols []string
+	rows []map[string]driver.Value
+}
+
+type fakeRow struct {
+	table  string
+	row    map[string]driver.Value
+	upsert bool
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	m map[string]*fakeDB
+}{m: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+	dialects["fake"] = &dialect{driver: "fakedb", quote: "`", timestamp: "DATETIME", createSchema: true}
+}
+
+// newFakeDB returns the data source name of a new empty database and the database.
+func newFakeDB(t *testing.T) (string, *fakeDB) {
+	db := &fakeDB{tables: make(map[string]*fakeTable), keys: "keys"}
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	dsn := fmt.Sprintf("%s-%d", t.Name(), len(fakeDBs.m))
+	fakeDBs.m[dsn] = db
+	return dsn, db
+}
+
+// rows returns the committed rows of table.
+func (db *fakeDB) rows(table string) []map[string]driver.Value {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if t, ok := db.tables[table]; ok {
+		return t.rows
+	}
+	return nil
+}
+
+func (db *fakeDB) create(table string, cols []string) {
+	if _, ok := db.tables[table]; !ok {
+		db.tables[table] = &fakeTable{cols: cols}
+	}
+}
+
+// primaryKey returns the columns identifying the rows of t.
+func (t *fakeTable) primaryKey() []string {
+	for _, c := range t.cols {
+		if c == "entry_id" {
+			return []string{"entry_id", "key_id"}
+		}
+	}
+	return []string{"id"}
+}
+
+// find returns the index of the row of t with the same primary key as row.
+func (t *fakeTable) find(rows []map[string]driver.Value, row map[string]driver.Value) int {
+	for i, r := range rows {
+		same := true
+		for _, c := range t.primaryKey() {
+			if fmt.Sprint(r[c]) != fmt.Sprint(row[c]) {
+				same = false
+			}
+		}
+		if same {
+			return i
+		}
+	}
+	return -1
+}
+
+// check returns an error if row can't be inserted in table, after the rows
+// of staged are.
+func (db *fakeDB) check(r fakeRow, staged []fakeRow) error {
+	t, ok := db.tables[r.table]
+	if !ok {
+		return fmt.Errorf("no such table: %s", r.table)
+	}
+	for c := range r.row {
+		found := false
+		for _, tc := range t.cols {
+			found = found || tc == c
+		}
+		if !found {
+			return fmt.Errorf("table %s has no column named %s", r.table, c)
+		}
+	}
+	rows := append([]map[string]driver.Value(nil), t.rows...)
+	for _, s := range staged {
+		if s.table == r.table {
+			rows = append(rows, s.row)
+		}
+	}
+	if !r.upsert && t.find(rows, r.row) >= 0 {
+		return fmt.Errorf("duplicate primary key in %s", r.table)
+	}
+	if id, ok := r.row["key_id"]; ok {
+		keys := append([]map[string]driver.Value(nil), db.tables[db.keys].rows...)
+		for _, s := range staged {
+			if s.table == db.keys {
+				keys = append(keys, s.row)
+			}
+		}
+		if (&fakeTable{}).find(keys, map[string]driver.Value{"id": id}) < 0 {
+			return fmt.Errorf("foreign key constraint failed: key %v", id)
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) insert(r fakeRow) {
+	t := db.tables[r.table]
+	if i := t.find(t.rows, r.row); i >= 0 {
+		t.rows[i] = r.row
+		return
+	}
+	t.rows = append(t.rows, r.row)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	db, ok := fakeDBs.m[dsn]
+	if !ok {
+		return nil, fmt.Errorf("no database %s", dsn)
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+	// Rows inserted by the transaction in progress, if any
+	tx     bool
+	staged []fakeRow
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.tx, c.staged = true, nil
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mux.Lock()
+	defer c.db.mux.Unlock()
+	for i, r := range c.staged {
+		if err := c.db.check(r, c.staged[:i]); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.staged {
+		c.db.insert(r)
+	}
+	c.db.commits++
+	c.tx, c.staged = false, nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.tx, c.staged = false, nil
+	return nil
+}
+
+var (
+	fakeCreate = regexp.MustCompile(`(?s)^CREATE TABLE IF NOT EXISTS (\S+) \((.*)\)$`)
+	fakeAlter  = regexp.MustCompile(`^ALTER TABLE (\S+) ADD COLUMN (\S+)`)
+	fakeInsert = regexp.MustCompile(`^INSERT INTO (\S+) \(([^)]*)\) VALUES \([^)]*\)(.*)$`)
+	fakeSelect = regexp.MustCompile(`^SELECT (.+) FROM (\S+)`)
+)
+
+func unquote(name string) string {
+	return strings.Trim(name, "`\"")
+}
+
+func splitColumns(s string) []string {
+	var cols []string
+	for _, c := range strings.Split(s, ",") {
+		cols = append(cols, unquote(strings.TrimSpace(c)))
+	}
+	return cols
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.c.db
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	if m := fakeCreate.FindStringSubmatch(s.query); m != nil {
+		var cols []string
+		for _, line := range strings.Split(m[2], "\n") {
+			if f := strings.Fields(line); len(f) > 0 && f[0] != "PRIMARY" {
+				cols = append(cols, f[0])
+			}
+		}
+		db.create(unquote(m[1]), cols)
+		return driver.RowsAffected(0), nil
+	}
+	if m := fakeAlter.FindStringSubmatch(s.query); m != nil {
+		t, ok := db.tables[unquote(m[1])]
+		if !ok {
+			return nil, fmt.Errorf("no such table: %s", m[1])
+		}
+		t.cols = append(t.cols, unquote(m[2]))
+		return driver.RowsAffected(0), nil
+	}
+	m := fakeInsert.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported statement: %s", s.query)
+	}
+	cols := splitColumns(m[2])
+	if len(cols) != len(args) {
+		return nil, fmt.Errorf("%d arguments for %d columns", len(args), len(cols))
+	}
+	r := fakeRow{table: unquote(m[1]), row: make(map[string]driver.Value), upsert: m[3] != ""}
+	for i, c := range cols {
+		r.row[c] = args[i]
+	}
+	if err := db.check(r, s.c.staged); err != nil {
+		return nil, err
+	}
+	if s.c.tx {
+		s.c.staged = append(s.c.staged, r)
+	} else {
+		db.insert(r)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.c.db
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	m := fakeSelect.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported query: %s", s.query)
+	}
+	t, ok := db.tables[unquote(m[2])]
+	if !ok {
+		return nil, fmt.Errorf("no such table: %s", m[2])
+	}
+	cols := splitColumns(m[1])
+	for _, c := range cols {
+		found := false
+		for _, tc := range t.cols {
+			found = found || tc == c
+		}
+		if !found {
+			return nil, fmt.Errorf("no such column: %s", c)
+		}
+	}
+	rows := &fakeRows{cols: cols}
+	if !strings.Contains(s.query, "WHERE 1 = 0") {
+		rows.rows = append(rows.rows, t.rows...)
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows []map[string]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, c := range r.cols {
+		dest[i] = r.rows[0][c]
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
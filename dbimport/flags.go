@@ -0,0 +1,67 @@
+package dbimport
+
+import "flag"
+
+// DefaultOptions are the defaults of the import flags.
+var DefaultOptions = Options{Driver: "mysql", Batch: 500, Workers: 1, Tables: DefaultTables}
+
+// Flags are the command line flags configuring an import, shared by the
+// tools importing records.
+type Flags struct {
+	driver     *string
+	batch      *int
+	workers    *int
+	upsert     *bool
+	initSchema *bool
+	entries    *string
+	values     *string
+	keys       *string
+	keyMap     *string
+	knownKeys  *bool
+	maxKeys    *int
+}
+
+// NewFlags defines the import flags in fs, their names starting with prefix
+// and their defaults taken from defaults.
+func NewFlags(fs *flag.FlagSet, prefix string, defaults Options) *Flags {
+	return &Flags{
+		driver:     fs.String(prefix+"driver", defaults.Driver, "Database driver: mysql, postgres or sqlite"),
+		batch:      fs.Int(prefix+"batch", defaults.Batch, "Number of records committed in each transaction"),
+		workers:    fs.Int(prefix+"db-workers", defaults.Workers, "Number of connections writing records in parallel"),
+		upsert:     fs.Bool(prefix+"upsert", defaults.Upsert, "Update rows already imported by a previous run instead of failing"),
+		initSchema: fs.Bool(prefix+"init-schema", defaults.InitSchema, "Create the tables if they do not exist"),
+		entries:    fs.String(prefix+"entries-table", defaults.Tables.Entries, "Name of the table of pages"),
+		values:     fs.String(prefix+"values-table", defaults.Tables.Values, "Name of the table of table values"),
+		keys:       fs.String(prefix+"keys-table", defaults.Tables.Keys, "Name of the table of table keys"),
+		keyMap:     fs.String(prefix+"key-map", "", "JSON file mapping key synonyms to their canonical key"),
+		knownKeys:  fs.Bool(prefix+"known-keys-only", false, "Drop keys that are not canonical keys in -"+prefix+"key-map"),
+		maxKeys:    fs.Int(prefix+"max-keys", 1000, "Warn when more than this many distinct keys are found (0 disables)"),
+	}
+}
+
+// Options returns the options set by the flags to import into dsn.
+func (f *Flags) Options(dsn string) (Options, error) {
+	policy, err := NewKeyPolicy(*f.keyMap, *f.knownKeys)
+	if err != nil {
+		return Options{}, err
+	}
+	return Options{
+		Driver:     *f.driver,
+		DSN:        dsn,
+		Batch:      *f.batch,
+		Workers:    *f.workers,
+		Upsert:     *f.upsert,
+		InitSchema: *f.initSchema,
+		Policy:     policy,
+		Tables: Tables{
+			Entries: *f.entries,
+			Values:  *f.values,
+			Keys:    *f.keys,
+		},
+	}, nil
+}
+
+// MaxKeys returns the number of distinct keys over which Report warns.
+func (f *Flags) MaxKeys() int {
+	return *f.maxKeys
+}
@@ -0,0 +1,58 @@
+package extract
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Checkpoint records the URLs of the pages done, one per line, so that an
+// interrupted run can be resumed without processing them again.
+type Checkpoint struct {
+	mux  sync.Mutex
+	f    *os.File
+	urls []string
+}
+
+// OpenCheckpoint reads the URLs already in filename and opens it to add more.
+// The file is created if it does not exist.
+func OpenCheckpoint(filename string) (*Checkpoint, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open checkpoint: %s", err)
+	}
+	c := &Checkpoint{f: f}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if url := strings.TrimSpace(scanner.Text()); url != "" {
+			c.urls = append(c.urls, url)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read checkpoint: %s", err)
+	}
+	return c, nil
+}
+
+// URLs returns the URLs that were in the file when it was opened.
+func (c *Checkpoint) URLs() []string {
+	return c.urls
+}
+
+// Add records url as done. It is safe to call from multiple goroutines.
+func (c *Checkpoint) Add(url string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, err := c.f.WriteString(url + "\n"); err != nil {
+		return fmt.Errorf("cannot write checkpoint: %s", err)
+	}
+	return nil
+}
+
+// Close closes the checkpoint file.
+func (c *Checkpoint) Close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,152 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Client issues the requests for pages and images alike.
+type Client struct {
+	HTTP *http.Client
+	// Credentials for HTTP basic auth, used when User is set
+	User     string
+	Password string
+	// UserAgent is sent with every request when set
+	UserAgent string
+	// Header holds further headers sent with every request
+	Header http.Header
+	// Number of retries on network errors and server errors
+	Retries int
+	// Wait before the first retry, doubled at each further attempt
+	Backoff time.Duration
+	// Limiter optionally paces all requests, retries included
+	Limiter *rate.Limiter
+	// Latency optionally records the duration of each request
+	Latency *Histogram
+}
+
+func (c *Client) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %s", err)
+	}
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	for k, vs := range c.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return req, nil
+}
+
+// Get issues a GET request for url, retrying on network and server errors.
+func (c *Client) Get(ctx context.Context, url string) (*http.Response, error) {
+	return c.do(ctx, "GET", url)
+}
+
+// Head issues a HEAD request for url, retrying on network and server errors.
+func (c *Client) Head(ctx context.Context, url string) (*http.Response, error) {
+	return c.do(ctx, "HEAD", url)
+}
+
+func (c *Client) do(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := c.newRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		if c.Limiter != nil {
+			if err := c.Limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		start := time.Now()
+		resp, err := c.HTTP.Do(req)
+		if c.Latency != nil {
+			c.Latency.Observe(time.Since(start))
+		}
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if attempt >= c.Retries {
+			return resp, err
+		}
+		if err == nil {
+			log.Printf("debug: retrying %s: unexpected status: %s", url, resp.Status)
+			resp.Body.Close()
+		} else {
+			log.Printf("debug: retrying %s: %s", url, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// Login posts the credentials to the Confluence login form at loginURL. The
+// session cookie it sets is kept in the cookie jar of the HTTP client, which
+// must have one, and is sent with all further requests.
+func (c *Client) Login(ctx context.Context, loginURL, user, password string) error {
+	if c.HTTP.Jar == nil {
+		return errors.New("HTTP client has no cookie jar")
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return fmt.Errorf("invalid login URL: %s", err)
+	}
+	form := url.Values{
+		"os_username": {user},
+		"os_password": {password},
+		"login":       {"Log in"},
+	}
+	req, err := c.newRequest("POST", loginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("cannot POST: %s", err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("cannot read response: %s", err)
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	// Confluence answers failed logins with the login form again, and sets a
+	// session cookie all the same. Successful ones redirect to another page.
+	if reason := resp.Header.Get("X-Seraph-LoginReason"); reason != "" && reason != "OK" {
+		return fmt.Errorf("login rejected: %s", reason)
+	}
+	if bytes.Contains(body, []byte(`name="os_password"`)) {
+		return errors.New("login form served again, check the credentials")
+	}
+	if len(c.HTTP.Jar.Cookies(u)) == 0 {
+		return errors.New("no session cookie received")
+	}
+	return nil
+}
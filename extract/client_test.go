@@ -0,0 +1,198 @@
+package extract
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	c := &Client{HTTP: &http.Client{Timeout: 50 * time.Millisecond}}
+	start := time.Now()
+	_, err := c.Get(context.Background(), srv.URL)
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("got %v, want a timeout error", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("gave up after %s", d)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if hits <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("third"))
+	}))
+	defer srv.Close()
+	c := &Client{HTTP: http.DefaultClient, Retries: 3, Backoff: time.Millisecond}
+	resp, err := c.Get(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "third" || hits != 3 {
+		t.Errorf("got %q after %d requests, want %q after 3", body, hits, "third")
+	}
+}
+
+func TestClientNoRetryNotFound(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	c := &Client{HTTP: http.DefaultClient, Retries: 3, Backoff: time.Millisecond}
+	resp, err := c.Get(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || hits != 1 {
+		t.Errorf("got %s after %d requests, want 404 after 1", resp.Status, hits)
+	}
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(append([]byte("GIF89a"), make([]byte, 64)...))
+	}))
+	defer srv.Close()
+	c := &Client{HTTP: http.DefaultClient, User: "alice", Password: "secret"}
+	// Pages and images are both fetched with the credentials
+	if _, err := NewMimedFromURL(context.Background(), c, srv.URL+"/page", 0); err != nil {
+		t.Errorf("page: %s", err)
+	}
+	i := NewImageProc(1, 16, c, NewImageFilter(0, 0, nil))
+	if _, err := i.Get(context.Background(), srv.URL+"/image.gif"); err != nil {
+		t.Errorf("image: %s", err)
+	}
+	anon := &Client{HTTP: http.DefaultClient}
+	if _, err := NewMimedFromURL(context.Background(), anon, srv.URL+"/page", 0); err == nil {
+		t.Error("expected an error without credentials")
+	}
+}
+
+func TestClientUserAgent(t *testing.T) {
+	agents := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+	}))
+	defer srv.Close()
+	c := &Client{HTTP: http.DefaultClient, UserAgent: "wiki-extract-mdata/test"}
+	for _, do := range []func(context.Context, string) (*http.Response, error){c.Get, c.Head} {
+		resp, err := do(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := <-agents; got != "wiki-extract-mdata/test" {
+			t.Errorf("got User-Agent %q, want %q", got, "wiki-extract-mdata/test")
+		}
+	}
+}
+
+// loginServer is a Confluence login form accepting alice with secret. Like
+// Confluence, it sets a session cookie even when it rejects the credentials.
+func loginServer(reason bool) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dologin.action", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("os_username") == "alice" && r.FormValue("os_password") == "secret" {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "alice", Path: "/"})
+			http.Redirect(w, r, "/dashboard.action", http.StatusFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "anonymous", Path: "/"})
+		if reason {
+			w.Header().Set("X-Seraph-LoginReason", "AUTHENTICATED_FAILED")
+		}
+		w.Write([]byte(`<html><body><form action="/dologin.action"><input name="os_username"><input type="password" name="os_password"></form></body></html>`))
+	})
+	mux.HandleFunc("/dashboard.action", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("JSESSIONID"); err != nil || c.Value != "alice" {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`<html><body>Dashboard</body></html>`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestLogin(t *testing.T) {
+	for _, reason := range []bool{false, true} {
+		srv := loginServer(reason)
+		login := func(user, password string) (*Client, error) {
+			jar, err := cookiejar.New(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &Client{HTTP: &http.Client{Jar: jar}}
+			return c, c.Login(context.Background(), srv.URL+"/dologin.action", user, password)
+		}
+		if _, err := login("alice", "wrong"); err == nil {
+			t.Errorf("login reason %v: wrong password accepted", reason)
+		}
+		c, err := login("alice", "secret")
+		if err != nil {
+			t.Fatalf("login reason %v: %s", reason, err)
+		}
+		resp, err := c.Get(context.Background(), srv.URL+"/dashboard.action")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("got %s after logging in, want 200", resp.Status)
+		}
+		srv.Close()
+	}
+}
+
+func TestClientRate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	c := &Client{HTTP: http.DefaultClient, Limiter: rate.NewLimiter(rate.Limit(20), 1)}
+	start := time.Now()
+	for n := 0; n < 4; n++ {
+		resp, err := c.Get(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The first request is let through at once, the others every 50ms
+	if d := time.Since(start); d < 140*time.Millisecond {
+		t.Errorf("4 requests at 20 per second took %s", d)
+	}
+}
@@ -0,0 +1,190 @@
+package extract
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// subpageLinks returns the URLs of the links in doc matching selector,
+// resolved against domain.
+func subpageLinks(doc *goquery.Document, domain, selector string) []string {
+	var urls []string
+	doc.Find(selector).Each(func(i int, s *goquery.Selection) {
+		href := nodeGetAttr(s.Get(0), "href")
+		if href != "" {
+			urls = append(urls, resolveURL(domain, href))
+		}
+	})
+	return urls
+}
+
+// page is a URL to process, depth levels of subpages below the input.
+type page struct {
+	url   string
+	depth int
+}
+
+// crawl holds the pages still to process during a run.
+type crawl struct {
+	pages chan page
+	// Pages queued and not yet processed
+	pending sync.WaitGroup
+	mux     sync.Mutex
+	visited map[string]struct{}
+	// Pages done by a previous run, read again only to find their subpages
+	done map[string]struct{}
+	// Closed to stop queuing and processing further pages
+	stop <-chan struct{}
+	// URLs matching any of these are not processed
+	exclude []*regexp.Regexp
+	// Closed by finish when enough pages were processed
+	full     chan struct{}
+	fullOnce sync.Once
+}
+
+func newCrawl(stop <-chan struct{}) *crawl {
+	return &crawl{
+		pages:   make(chan page),
+		visited: make(map[string]struct{}),
+		done:    make(map[string]struct{}),
+		stop:    stop,
+		full:    make(chan struct{}),
+	}
+}
+
+// finish stops queuing and processing further pages.
+func (c *crawl) finish() {
+	c.fullOnce.Do(func() { close(c.full) })
+}
+
+// stopped reports whether no further pages must be processed.
+func (c *crawl) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	case <-c.full:
+		return true
+	default:
+		return false
+	}
+}
+
+// excluded reports whether url must not be processed.
+func (c *crawl) excluded(url string) bool {
+	for _, re := range c.exclude {
+		if re.MatchString(url) {
+			log.Printf("debug: skipping excluded URL: %s", url)
+			return true
+		}
+	}
+	return false
+}
+
+// visitKey returns the form of rawurl used to tell whether it was visited:
+// links to the same page can differ in the fragment, the case of the host
+// or a trailing slash.
+func visitKey(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	u.Fragment = ""
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Path != "/" {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+	}
+	return u.String()
+}
+
+// isDone reports whether url was done by a previous run. The pages done are
+// only set before the run starts.
+func (c *crawl) isDone(url string) bool {
+	_, ok := c.done[visitKey(url)]
+	return ok
+}
+
+// visit reports whether url was not seen before, marking it as seen.
+// It is safe to call from multiple goroutines.
+func (c *crawl) visit(url string) bool {
+	key := visitKey(url)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.visited[key]; ok {
+		log.Printf("debug: skipping duplicate URL: %s", url)
+		return false
+	}
+	c.visited[key] = struct{}{}
+	return true
+}
+
+// accept reports whether url read from the input must be processed: it is
+// neither excluded nor seen before.
+func (c *crawl) accept(url string) bool {
+	return !c.excluded(url) && c.visit(url)
+}
+
+// Filter sends to out the URLs read from in that a run would start from,
+// leaving out the excluded ones and the duplicates, without fetching them.
+// It closes out when in is closed.
+func Filter(in <-chan string, exclude []*regexp.Regexp, out chan<- string) {
+	defer close(out)
+	c := newCrawl(nil)
+	c.exclude = exclude
+	for url := range in {
+		if c.accept(url) {
+			out <- url
+		}
+	}
+}
+
+// add queues pg unless its URL was already seen. It doesn't block, so that
+// workers can queue the subpages they find.
+func (c *crawl) add(ctx context.Context, pg page) {
+	if c.stopped() || c.excluded(pg.url) || !c.visit(pg.url) {
+		return
+	}
+	c.pending.Add(1)
+	go func() {
+		select {
+		case c.pages <- pg:
+		case <-c.stop:
+			c.pending.Done()
+		case <-c.full:
+			c.pending.Done()
+		case <-ctx.Done():
+			c.pending.Done()
+		}
+	}()
+}
+
+// feed queues the URLs read from in, in order, and closes the queue once they
+// and all the subpages found in the meantime are processed.
+func (c *crawl) feed(ctx context.Context, in <-chan string) {
+	// Keep the queue open while reading in
+	c.pending.Add(1)
+	for url := range in {
+		if !c.accept(url) {
+			continue
+		}
+		c.pending.Add(1)
+		select {
+		case c.pages <- page{url: url}:
+		case <-c.stop:
+			c.pending.Done()
+		case <-c.full:
+			c.pending.Done()
+		case <-ctx.Done():
+			c.pending.Done()
+		}
+	}
+	c.pending.Done()
+	c.pending.Wait()
+	close(c.pages)
+}
@@ -0,0 +1,320 @@
+package extract
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wikiServer serves pages titled by their path, each linking to the subpages
+// in children.
+func wikiServer(children map[string][]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><body><h1 id="title-text"><a href="%s">%s</a></h1><div id="page-children">`, r.URL.Path, r.URL.Path)
+		for _, c := range children[r.URL.Path] {
+			fmt.Fprintf(w, `<a href="%s">%s</a>`, c, c)
+		}
+		fmt.Fprint(w, `</div></body></html>`)
+	}))
+}
+
+// records processes urls with p and returns the decoded records.
+func records(p *Processor, urls ...string) []map[string]interface{} {
+	in := make(chan string, len(urls))
+	for _, url := range urls {
+		in <- url
+	}
+	close(in)
+	out := make(chan []byte)
+	go p.Run(context.Background(), 2, in, out)
+	var recs []map[string]interface{}
+	for data := range out {
+		var rec map[string]interface{}
+		json.Unmarshal(data, &rec)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// run processes urls with p and returns the titles of the records.
+func run(p *Processor, urls ...string) []string {
+	var titles []string
+	for _, rec := range records(p, urls...) {
+		title, _ := rec["_title"].(map[string]interface{})
+		text, _ := title["text"].(string)
+		titles = append(titles, text)
+	}
+	return titles
+}
+
+func TestCheckpointResumeSubpages(t *testing.T) {
+	srv := wikiServer(map[string][]string{"/root": {"/child"}, "/child": {"/grandchild"}})
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "done")
+	// The run was interrupted after the root page
+	if err := ioutil.WriteFile(filename, []byte(srv.URL+"/root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := OpenCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	p := NewProcessor(srv.URL)
+	p.Depth = 2
+	p.Checkpoint = cp
+	titles := run(p, srv.URL+"/root")
+	if len(titles) != 2 {
+		t.Fatalf("got pages %v, want /child and /grandchild", titles)
+	}
+	for _, title := range titles {
+		if title == "/root" {
+			t.Errorf("page done by the previous run extracted again")
+		}
+	}
+}
+
+func TestSkipFailedPages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/baddate":
+			fmt.Fprint(w, `<html><body><div class="page-metadata-modification-info"><span class="last-modified">sometime</span></div></body></html>`)
+		default:
+			fmt.Fprint(w, `<html><body><h1 id="title-text"><a href="/ok">ok</a></h1></body></html>`)
+		}
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	titles := run(p, srv.URL+"/missing", srv.URL+"/baddate", srv.URL+"/ok")
+	if len(titles) != 1 || titles[0] != "ok" {
+		t.Errorf("got pages %v, want only ok", titles)
+	}
+	s := p.Stats()
+	if s.Processed != 1 || s.ReadFailed != 1 || s.ExtractFailed != 1 || p.Failed() != 2 {
+		t.Errorf("got stats %+v, want 1 processed, 1 not read and 1 not extracted", s)
+	}
+}
+
+func TestEmptyAndFileURLs(t *testing.T) {
+	f, err := ioutil.TempFile("", "page*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `<html><body><h1 id="title-text"><a href="/local">local</a></h1></body></html>`)
+	f.Close()
+	p := NewProcessor("http://wiki.local")
+	// URLs shorter than the file:// prefix must not be sliced past their end
+	titles := run(p, "", "file", "file://"+f.Name())
+	if len(titles) != 1 || titles[0] != "local" {
+		t.Errorf("got pages %v, want only the local file", titles)
+	}
+	if s := p.Stats(); s.ReadFailed != 1 {
+		t.Errorf("got %d pages not read, want 1 for the short URL", s.ReadFailed)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	cancelled := make(chan struct{}, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	// The input is never closed, only the context ends the run
+	in := make(chan string, 1)
+	in <- srv.URL + "/slow"
+	out := make(chan []byte)
+	go p.Run(ctx, 2, in, out)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("got a record from a cancelled run")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("output not closed after cancelling the run")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Error("outstanding request not cancelled")
+	}
+}
+
+func TestDepth(t *testing.T) {
+	srv := wikiServer(map[string][]string{"/root": {"/child"}, "/child": {"/grandchild"}})
+	defer srv.Close()
+	for depth, want := range []int{1, 2, 3, 3} {
+		p := NewProcessor(srv.URL)
+		p.Depth = depth
+		if titles := run(p, srv.URL+"/root"); len(titles) != want {
+			t.Errorf("depth %d: got pages %v, want %d", depth, titles, want)
+		}
+	}
+}
+
+func TestDuplicateLinks(t *testing.T) {
+	srv := wikiServer(map[string][]string{
+		// Links to the same child and back to the root, in different forms
+		"/root":  {"/child", "/child/", "/child#section", "/root"},
+		"/child": {"/root/"},
+	})
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	p.Depth = 3
+	titles := run(p, srv.URL+"/root", strings.ToUpper(srv.URL[:4])+srv.URL[4:]+"/root")
+	if len(titles) != 2 {
+		t.Errorf("got pages %v, want /root and /child once", titles)
+	}
+}
+
+func TestVisitKey(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"http://wiki.local/x", "http://wiki.local/x#top"},
+		{"http://wiki.local/x", "http://WIKI.local/x"},
+		{"http://wiki.local/x", "HTTP://wiki.local/x"},
+		{"http://wiki.local/x", "http://wiki.local/x/"},
+	}
+	for _, tt := range tests {
+		if visitKey(tt.a) != visitKey(tt.b) {
+			t.Errorf("%s and %s are different pages", tt.a, tt.b)
+		}
+	}
+	if visitKey("http://wiki.local/x?pageId=1") == visitKey("http://wiki.local/x?pageId=2") {
+		t.Error("pages with different ids are the same")
+	}
+}
+
+func TestPageTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.gif" {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		fmt.Fprint(w, `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>Logo</th><td><img src="/slow.gif"></td></tr></table></div></body></html>`)
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	p.PageTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if titles := run(p, srv.URL+"/page"); len(titles) != 0 {
+		t.Errorf("got pages %v, want none", titles)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("gave up after %s", d)
+	}
+	if s := p.Stats(); s.ExtractFailed != 1 {
+		t.Errorf("got %d pages not extracted, want 1", s.ExtractFailed)
+	}
+}
+
+func TestSourceURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		fmt.Fprint(w, `<html><body><h1 id="title-text"><a href="/new">new</a></h1></body></html>`)
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	// The source is the URL after redirects
+	recs := records(p, srv.URL+"/old")
+	if len(recs) != 1 || recs[0]["_source_url"] != srv.URL+"/new" {
+		t.Errorf("got records %v, want one with _source_url %s/new", recs, srv.URL)
+	}
+	p = NewProcessor(srv.URL)
+	p.Omit = map[string]bool{"_source_url": true}
+	recs = records(p, srv.URL+"/new")
+	if _, ok := recs[0]["_source_url"]; len(recs) != 1 || ok {
+		t.Errorf("got records %v, want one without _source_url", recs)
+	}
+	// Pages read from r have no source
+	data, err := NewProcessor(srv.URL).ProcessPage(context.Background(), strings.NewReader(`<html><body></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "_source_url") {
+		t.Errorf("got %s, want no _source_url", data)
+	}
+}
+
+func TestMaxPages(t *testing.T) {
+	var children []string
+	for n := 0; n < 20; n++ {
+		children = append(children, fmt.Sprintf("/child%d", n))
+	}
+	srv := wikiServer(map[string][]string{"/root": children})
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	p.Depth = 1
+	p.MaxPages = 3
+	if titles := run(p, srv.URL+"/root"); len(titles) != 3 {
+		t.Errorf("got pages %v, want 3", titles)
+	}
+	if s := p.Stats(); s.Processed != 3 {
+		t.Errorf("got %d pages processed, want 3", s.Processed)
+	}
+}
+
+func TestRedirectDuplicates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/alias") {
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		fmt.Fprintf(w, `<html><body><h1 id="title-text"><a href="%s">%s</a></h1></body></html>`, r.URL.Path, r.URL.Path)
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	// Pages reached under several URLs are extracted once
+	recs := records(p, srv.URL+"/alias1", srv.URL+"/alias2", srv.URL+"/page", srv.URL+"/other")
+	var sources []string
+	for _, rec := range recs {
+		sources = append(sources, fmt.Sprint(rec["_source_url"]))
+	}
+	if len(recs) != 2 {
+		t.Errorf("got pages from %v, want /page and /other once", sources)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	in := make(chan string, 5)
+	for _, url := range []string{"http://wiki.local/a", "http://wiki.local/draft", "http://WIKI.local/a#top", "http://wiki.local/b/", "http://wiki.local/b"} {
+		in <- url
+	}
+	close(in)
+	out := make(chan string)
+	go Filter(in, []*regexp.Regexp{regexp.MustCompile("draft")}, out)
+	var urls []string
+	for url := range out {
+		urls = append(urls, url)
+	}
+	if want := "http://wiki.local/a http://wiki.local/b/"; strings.Join(urls, " ") != want {
+		t.Errorf("got %v, want %s", urls, want)
+	}
+}
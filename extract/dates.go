@@ -0,0 +1,63 @@
+package extract
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Absolute date layouts used by Confluence, tried in order.
+var dateLayouts = []string{
+	"02 Jan 2006",
+	"2 Jan 2006",
+	"Jan 02, 2006",
+	"Jan 2, 2006",
+	"January 2, 2006",
+	"2006-01-02",
+}
+
+var (
+	relativeAgo = regexp.MustCompile(`^(?:about )?(\d+|an?) (minute|hour|day|week)s? ago$`)
+	relativeAt  = regexp.MustCompile(`^(today|yesterday) at (\d{1,2}:\d{2})$`)
+)
+
+var relativeUnits = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// parseDate parses an absolute or relative modification date, resolving relative dates against now.
+func parseDate(text string, now time.Time) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, text); err == nil {
+			return date, nil
+		}
+	}
+	lower := strings.ToLower(text)
+	if lower == "just a moment ago" {
+		return now, nil
+	}
+	if m := relativeAgo.FindStringSubmatch(lower); m != nil {
+		n := 1
+		if m[1] != "a" && m[1] != "an" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		return now.Add(-time.Duration(n) * relativeUnits[m[2]]), nil
+	}
+	if m := relativeAt.FindStringSubmatch(lower); m != nil {
+		clock, err := time.Parse("15:04", m[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time of day: %s", err)
+		}
+		day := now
+		if m[1] == "yesterday" {
+			day = now.AddDate(0, 0, -1)
+		}
+		return time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location()), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown date format: %q", text)
+}
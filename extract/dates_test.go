@@ -0,0 +1,67 @@
+package extract
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	now := time.Date(2020, 3, 10, 15, 30, 0, 0, time.UTC)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"05 Feb 2019", day(2019, 2, 5)},
+		{"5 Feb 2019", day(2019, 2, 5)},
+		{"Feb 05, 2019", day(2019, 2, 5)},
+		{"Feb 5, 2019", day(2019, 2, 5)},
+		{"February 5, 2019", day(2019, 2, 5)},
+		{"2019-02-05", day(2019, 2, 5)},
+		{"just a moment ago", now},
+		{"a minute ago", now.Add(-time.Minute)},
+		{"5 minutes ago", now.Add(-5 * time.Minute)},
+		{"an hour ago", now.Add(-time.Hour)},
+		{"about 3 hours ago", now.Add(-3 * time.Hour)},
+		{"2 days ago", now.Add(-48 * time.Hour)},
+		{"1 week ago", now.Add(-7 * 24 * time.Hour)},
+		{"Today at 9:05", time.Date(2020, 3, 10, 9, 5, 0, 0, time.UTC)},
+		{"yesterday at 23:59", time.Date(2020, 3, 9, 23, 59, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseDate(tt.text, now)
+		if err != nil {
+			t.Errorf("%q: %s", tt.text, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%q: got %s, want %s", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseDateInvalid(t *testing.T) {
+	now := time.Date(2020, 3, 10, 15, 30, 0, 0, time.UTC)
+	for _, text := range []string{"", "sometime", "5 years ago", "today at 25:00", "31 Feb 2019"} {
+		if got, err := parseDate(text, now); err == nil {
+			t.Errorf("%q: got %s, want an error", text, got)
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	date := time.Date(2019, 2, 5, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		layout string
+		want   interface{}
+	}{
+		{"", "2019-02-05T10:00:00Z"},
+		{"unix", int64(1549360800)},
+		{"2006-01-02", "2019-02-05"},
+	}
+	for _, tt := range tests {
+		if got := formatDate(date, tt.layout); got != tt.want {
+			t.Errorf("%q: got %#v, want %#v", tt.layout, got, tt.want)
+		}
+	}
+}
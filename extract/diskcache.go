@@ -0,0 +1,70 @@
+package extract
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCache stores downloaded resources in a directory, in files named after
+// a hash of their URL. Each file holds the MIME type on the first line,
+// followed by the data.
+type diskCache string
+
+func (c diskCache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(string(c), hex.EncodeToString(sum[:]))
+}
+
+// get returns the stored resource and when it was stored.
+func (c diskCache) get(url string) (*Mimed, time.Time, bool) {
+	name := c.path(url)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	n := bytes.IndexByte(data, '\n')
+	if n < 0 {
+		return nil, time.Time{}, false
+	}
+	return &Mimed{mime: string(data[:n]), data: data[n+1:]}, fi.ModTime(), true
+}
+
+// put stores m atomically and checks it reads back unchanged.
+func (c diskCache) put(url string, m *Mimed) error {
+	tmp, err := ioutil.TempFile(string(c), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("cannot create cache file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write([]byte(m.mime + "\n")); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write cache file: %s", err)
+	}
+	if _, err := tmp.Write(m.data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write cache file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write cache file: %s", err)
+	}
+	name := c.path(url)
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("cannot store cache file: %s", err)
+	}
+	stored, _, ok := c.get(url)
+	if !ok || stored.mime != m.mime || !bytes.Equal(stored.data, m.data) {
+		os.Remove(name)
+		return fmt.Errorf("cache file %s is corrupted", name)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package extract_test
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/dullgiulio/wiki-extract-mdata/extract"
+)
+
+func ExampleExtract() {
+	page := `<html><body>
+<h1 id="title-text"><a href="/display/TEAM/Service">Service</a></h1>
+<div id="main-content"><table class="confluenceTable">
+<tr><th>Owner</th><td>alice</td></tr>
+<tr><th>Status</th><td>In production</td></tr>
+</table></div>
+</body></html>`
+	vals, err := extract.Extract(strings.NewReader(page))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, key := range vals.Keys() {
+		val, _ := vals.Get(key)
+		fmt.Printf("%s: %s\n", strings.TrimSpace(key), strings.TrimSpace(fmt.Sprint(val)))
+	}
+	// Output:
+	// _title: map[text:Service url:/display/TEAM/Service]
+	// Owner: alice
+	// Status: In production
+}
+
+func ExampleParseSubpages() {
+	index := `<html><body><div id="page-children">
+<a href="/display/TEAM/Service">Service</a>
+<a>Draft</a>
+<a href="https://other.local/display/X">Elsewhere</a>
+</div></body></html>`
+	urls, err := extract.ParseSubpages(strings.NewReader(index), "http://wiki.local", extract.DefaultSelectors.Subpages)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, url := range urls {
+		fmt.Println(url)
+	}
+	// Output:
+	// http://wiki.local/display/TEAM/Service
+	// https://other.local/display/X
+}
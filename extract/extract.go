@@ -0,0 +1,1159 @@
+// Package extract extracts metadata from the pages of a Confluence wiki.
+package extract
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/xeipuuv/gojsonschema"
+	"golang.org/x/net/html"
+)
+
+func nodeGetAttr(node *html.Node, attr string) string {
+	for n := range node.Attr {
+		if node.Attr[n].Key == attr {
+			return strings.TrimSpace(node.Attr[n].Val)
+		}
+	}
+	return ""
+}
+
+// resolveURL returns the URL of href on the wiki at domain, resolved like a
+// browser would on a page at domain. An empty href stays empty.
+func resolveURL(domain, href string) string {
+	if href == "" {
+		return ""
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return domain + href
+	}
+	if !strings.HasSuffix(domain, "/") {
+		domain += "/"
+	}
+	base, err := url.Parse(domain)
+	if err != nil {
+		return domain + href
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// Slug turns s into a lowercase string safe to use in filenames.
+func Slug(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// ParseSubpages returns the URLs of the subpages listed in the page read from r,
+// found with selector and resolved against domain. Links without href are skipped.
+func ParseSubpages(r io.Reader, domain, selector string) ([]string, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query document: %s", err)
+	}
+	return subpageLinks(doc, domain, selector), nil
+}
+
+// EmitSubpages sends to out the URLs of the subpages listed in the page read from r,
+// found with selector and prefixed with domain. It closes out when done.
+func EmitSubpages(ctx context.Context, r io.Reader, domain, selector string, out chan<- string) error {
+	defer close(out)
+	urls, err := ParseSubpages(r, domain, selector)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		select {
+		case out <- url:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type byteTo []byte
+
+func (b byteTo) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte(b))
+	return int64(n), err
+}
+
+// wrapTo writes src between before and after.
+type wrapTo struct {
+	before string
+	src    io.WriterTo
+	after  string
+}
+
+func (t *wrapTo) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte(t.before))
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := t.src.WriteTo(w)
+	m += int64(n)
+	if err != nil {
+		return m, err
+	}
+	n, err = w.Write([]byte(t.after))
+	return m + int64(n), err
+}
+
+// ImageMode selects how images are included in the rendered text.
+type ImageMode int
+
+const (
+	// ImagesInline embeds images as data URIs, subject to the image filter.
+	ImagesInline ImageMode = iota
+	// ImagesLink references images by URL without downloading them.
+	ImagesLink
+	// ImagesDownload saves images in a directory and references their files.
+	ImagesDownload
+)
+
+// ParseImageMode returns the ImageMode called name.
+func ParseImageMode(name string) (ImageMode, bool) {
+	switch name {
+	case "inline":
+		return ImagesInline, true
+	case "link":
+		return ImagesLink, true
+	case "download":
+		return ImagesDownload, true
+	}
+	return 0, false
+}
+
+// DefaultContentSelectors are the selectors for the main content of the page
+// used by NewProcessor.
+var DefaultContentSelectors = []string{"#main-content", "#content .wiki-content", ".page-content"}
+
+// Processor extracts metadata from wiki pages.
+type Processor struct {
+	// Domain is prefixed to relative links.
+	Domain string
+	Client *Client
+	Images *ImageProc
+	Render Renderer
+	// Records sent or about to be sent, for MaxPages
+	sent int64
+	// Links to the wiki that don't resolve, if checked
+	links *linkChecker
+	// Page metadata keys not to extract, like _author.
+	Omit map[string]bool
+	// Render the main content without the metadata tables as _body.
+	IncludeBody bool
+	// Selectors for the parts of the page.
+	Selectors Selectors
+	// Selectors for the main content root, tried in order.
+	ContentSelectors []string
+	// Directory where data grid tables are written as CSV. Empty disables it.
+	TablesDir string
+	// Indent the JSON records produced by ProcessPage.
+	Pretty bool
+	// How images are included in the rendered text.
+	ImageMode ImageMode
+	// Directory where images are saved with ImagesDownload.
+	ImageDir string
+	// Checkpoint optionally skips the pages done by a previous run, read
+	// again only to follow their subpages, and records the pages done by
+	// this one.
+	Checkpoint *Checkpoint
+	// Schema optionally skips the records that don't match it
+	Schema *gojsonschema.Schema
+	// DateFormat is the layout of _date, or "unix" for seconds since the
+	// epoch. The default is RFC 3339.
+	DateFormat string
+	// Exclude skips the pages with URLs matching any of these, whether read
+	// from the input or found as subpages.
+	Exclude []*regexp.Regexp
+	// GroupTables keeps the keys of each table apart in _table_groups,
+	// instead of merging them with the page metadata.
+	GroupTables bool
+	// MaxPages stops the run after this many records are sent. Zero means
+	// no limit.
+	MaxPages int64
+	// Stop, when closed, makes Run finish the pages being processed and
+	// skip all the others.
+	Stop <-chan struct{}
+	// PageTimeout limits the time to read and extract each page, images
+	// included. Zero means no limit.
+	PageTimeout time.Duration
+	// Depth is how many levels of subpages of the processed pages are
+	// processed as well. Zero only processes the pages sent to Run.
+	Depth int
+	stats Stats
+}
+
+// NewProcessor returns a Processor for domain with default settings.
+func NewProcessor(domain string) *Processor {
+	client := &Client{HTTP: http.DefaultClient}
+	return &Processor{
+		Domain:           domain,
+		Client:           client,
+		Images:           NewImageProc(1, 256, client, NewImageFilter(0, 0, nil)),
+		Render:           TextRenderer{},
+		Selectors:        DefaultSelectors,
+		ContentSelectors: DefaultContentSelectors,
+	}
+}
+
+// Extract extracts the metadata of the page read from r with default settings.
+func Extract(r io.Reader) (Values, error) {
+	return NewProcessor("").Extract(context.Background(), r)
+}
+
+// CheckLinks makes the processor report the links to pages of the wiki that
+// don't resolve as _broken_links. The links are checked with HEAD requests.
+func (p *Processor) CheckLinks() {
+	p.links = newLinkChecker(p.Client)
+}
+
+// Stats counts the outcomes of processing pages.
+type Stats struct {
+	// Pages extracted
+	Processed int64
+	// Pages that could not be read
+	ReadFailed int64
+	// Pages that could not be parsed or extracted
+	ExtractFailed int64
+	// Images replaced by a placeholder
+	ImagesUnavailable int64
+	// Records skipped for not matching the schema
+	Invalid int64
+}
+
+// Stats returns the counts of the pages processed so far.
+func (p *Processor) Stats() Stats {
+	return Stats{
+		Processed:         atomic.LoadInt64(&p.stats.Processed),
+		ReadFailed:        atomic.LoadInt64(&p.stats.ReadFailed),
+		ExtractFailed:     atomic.LoadInt64(&p.stats.ExtractFailed),
+		ImagesUnavailable: atomic.LoadInt64(&p.stats.ImagesUnavailable),
+		Invalid:           atomic.LoadInt64(&p.stats.Invalid),
+	}
+}
+
+// Failed returns the number of pages that could not be read or extracted.
+func (p *Processor) Failed() int64 {
+	s := p.Stats()
+	return s.ReadFailed + s.ExtractFailed
+}
+
+// Run processes the pages at the URLs read from domains with nworkers workers,
+// sending the extracted JSON records to out. Subpages are followed up to
+// p.Depth levels and each URL is processed once. It closes out when done.
+func (p *Processor) Run(ctx context.Context, nworkers int, domains <-chan string, out chan<- []byte) {
+	c := newCrawl(p.Stop)
+	c.exclude = p.Exclude
+	if p.Checkpoint != nil {
+		for _, url := range p.Checkpoint.URLs() {
+			c.done[visitKey(url)] = struct{}{}
+		}
+	}
+	go c.feed(ctx, domains)
+	wg := &sync.WaitGroup{}
+	wg.Add(nworkers)
+	for i := 0; i < nworkers; i++ {
+		go p.process(ctx, c, out, wg)
+	}
+	wg.Wait()
+	close(out)
+}
+
+// RenderText writes the text content of node and its children to w.
+func (p *Processor) RenderText(ctx context.Context, w io.Writer, node *html.Node) error {
+	if node == nil || node.Type == html.CommentNode {
+		return nil
+	}
+	// Keep scripts and styles out of the text
+	if node.Type == html.ElementNode && (node.Data == "script" || node.Data == "style") {
+		return nil
+	}
+	if node.Type == html.TextNode {
+		data := strings.TrimSpace(strings.Replace(node.Data, "\u00a0", " ", -1))
+		_, err := w.Write([]byte(data))
+		return err
+	}
+	// Keep the structure of tables nested in a cell
+	if node.Type == html.ElementNode && node.Data == "table" {
+		return p.renderTable(ctx, w, node)
+	}
+	// Code must keep its whitespace
+	if node.Type == html.ElementNode && node.Data == "pre" {
+		_, err := io.WriteString(w, p.Render.pre(rawText(node)))
+		return err
+	}
+	if node.Type == html.ElementNode && hasClass(node, "expand-container") {
+		return p.renderExpand(ctx, w, node)
+	}
+	if node.Type == html.ElementNode {
+		if mark := p.Render.emphasis(node); mark != "" {
+			return p.renderEmphasis(ctx, w, node, mark)
+		}
+	}
+	var after, before io.WriterTo
+	if node.Type == html.ElementNode {
+		before, after = p.Render.decorate(ctx, p, node)
+	}
+	if before != nil {
+		if _, err := before.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	for node = node.FirstChild; node != nil; node = node.NextSibling {
+		if err := p.RenderText(ctx, w, node); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		if _, err := after.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderEmphasis renders the content of node between mark, with the
+// whitespace around the content moved outside of the marks.
+func (p *Processor) renderEmphasis(ctx context.Context, w io.Writer, node *html.Node, mark string) error {
+	var buf bytes.Buffer
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if err := p.RenderText(ctx, &buf, c); err != nil {
+			return err
+		}
+	}
+	text := strings.TrimSpace(buf.String())
+	if text == "" {
+		_, err := io.WriteString(w, " ")
+		return err
+	}
+	_, err := io.WriteString(w, " "+mark+text+mark+" ")
+	return err
+}
+
+// renderExpand renders the title and the collapsed content of an expand macro
+// as a block, so that it doesn't run into the surrounding text.
+func (p *Processor) renderExpand(ctx context.Context, w io.Writer, node *html.Node) error {
+	var title, body bytes.Buffer
+	if n := findClass(node, "expand-control-text"); n != nil {
+		if err := p.RenderText(ctx, &title, n); err != nil {
+			return err
+		}
+	}
+	if n := findClass(node, "expand-content"); n != nil {
+		if err := p.RenderText(ctx, &body, n); err != nil {
+			return err
+		}
+	}
+	t := strings.TrimSpace(title.String())
+	if t == "" {
+		t = "Details"
+	}
+	_, err := io.WriteString(w, p.Render.expand(t, strings.TrimSpace(body.String())))
+	return err
+}
+
+// childElements returns the children of node that are one of the named elements.
+func childElements(node *html.Node, names ...string) []*html.Node {
+	var nodes []*html.Node
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		for _, name := range names {
+			if c.Data == name {
+				nodes = append(nodes, c)
+				break
+			}
+		}
+	}
+	return nodes
+}
+
+// renderTable renders a table as lines of pipe separated cells.
+func (p *Processor) renderTable(ctx context.Context, w io.Writer, table *html.Node) error {
+	rows := childElements(table, "tr")
+	for _, section := range childElements(table, "thead", "tbody", "tfoot") {
+		rows = append(rows, childElements(section, "tr")...)
+	}
+	if _, err := w.Write([]byte("\n")); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var line bytes.Buffer
+		line.WriteString("|")
+		for _, cell := range childElements(row, "th", "td") {
+			var buf bytes.Buffer
+			if err := p.RenderText(ctx, &buf, cell); err != nil {
+				return err
+			}
+			line.WriteString(" " + strings.TrimSpace(buf.String()) + " |")
+		}
+		line.WriteString("\n")
+		if _, err := line.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageSrc returns the source to use for the image at url, or nil if the image is skipped.
+func (p *Processor) imageSrc(ctx context.Context, url string) (io.WriterTo, error) {
+	if p.ImageMode == ImagesLink {
+		return byteTo([]byte(url)), nil
+	}
+	img, err := p.Images.Get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	action := p.Images.filter.action(img)
+	if action == imgSkip {
+		return nil, nil
+	}
+	if p.ImageMode == ImagesDownload {
+		name, err := p.Images.Save(img, p.ImageDir)
+		if err != nil {
+			return nil, err
+		}
+		return byteTo([]byte(filepath.ToSlash(filepath.Join(p.ImageDir, name)))), nil
+	}
+	if action == imgReference {
+		return byteTo([]byte(url)), nil
+	}
+	return img, nil
+}
+
+// image returns what to render in place of the image at url, or nil to render nothing.
+func (p *Processor) image(ctx context.Context, url string) io.WriterTo {
+	src, err := p.imageSrc(ctx, url)
+	// Silently skip images we cannot get
+	if err != nil {
+		log.Printf("warning: cannot include image %s: %s", url, err)
+		atomic.AddInt64(&p.stats.ImagesUnavailable, 1)
+		return byteTo([]byte(" [image unavailable] "))
+	}
+	if src == nil {
+		return nil
+	}
+	return p.Render.image(src)
+}
+
+var versionNumber = regexp.MustCompile(`\d+`)
+
+// parseVersion returns the first number in text, as in "v. 12".
+func parseVersion(text string) (int, bool) {
+	n, err := strconv.Atoi(versionNumber.FindString(text))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func (p *Processor) metadata(ctx context.Context, doc *goquery.Document, vals *Values) error {
+	var err error
+	set := func(key string, val interface{}) {
+		if !p.Omit[key] {
+			vals.Set(key, val)
+		}
+	}
+	// Use the first anchor with some text, it might contain markup
+	doc.Find(p.Selectors.Title).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		text := strings.TrimSpace(s.Text())
+		if text == "" {
+			return true
+		}
+		href := nodeGetAttr(s.Get(0), "href")
+		set("_title", map[string]string{
+			"text": text,
+			"url":  resolveURL(p.Domain, href),
+		})
+		return false
+	})
+	doc.Find(p.Selectors.Emoji).First().Each(func(i int, s *goquery.Selection) {
+		emoji := nodeGetAttr(s.Get(0), "data-emoji-fallback")
+		if emoji == "" {
+			emoji = strings.TrimSpace(s.Text())
+		}
+		if emoji != "" {
+			set("_emoji", emoji)
+		}
+	})
+	doc.Find(p.Selectors.CoverImage).First().Each(func(i int, s *goquery.Selection) {
+		src := nodeGetAttr(s.Get(0), "src")
+		if src == "" || p.Omit["_cover_image"] {
+			return
+		}
+		url := resolveURL(p.Domain, src)
+		img, e := p.imageSrc(ctx, url)
+		if e != nil {
+			log.Printf("warning: cannot include cover image %s: %s", url, e)
+			atomic.AddInt64(&p.stats.ImagesUnavailable, 1)
+			img = byteTo([]byte(url))
+		}
+		if img == nil {
+			return
+		}
+		var buf bytes.Buffer
+		if _, e := img.WriteTo(&buf); e != nil {
+			log.Printf("warning: cannot include cover image %s: %s", url, e)
+			return
+		}
+		set("_cover_image", buf.String())
+	})
+	// The author link might be empty, as for anonymous edits
+	doc.Find(p.Selectors.Author).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		name := strings.TrimSpace(s.Text())
+		if name == "" {
+			return true
+		}
+		href := nodeGetAttr(s.Get(0), "href")
+		set("_author", map[string]string{
+			"name": name,
+			"url":  resolveURL(p.Domain, href),
+		})
+		return false
+	})
+	var breadcrumbs []map[string]string
+	doc.Find(p.Selectors.Breadcrumbs).Each(func(i int, s *goquery.Selection) {
+		breadcrumbs = append(breadcrumbs, map[string]string{
+			"text": strings.TrimSpace(s.Text()),
+			"url":  resolveURL(p.Domain, nodeGetAttr(s.Get(0), "href")),
+		})
+	})
+	if len(breadcrumbs) > 0 {
+		set("_breadcrumbs", breadcrumbs)
+	}
+	var labels []string
+	doc.Find(p.Selectors.Labels).Each(func(i int, s *goquery.Selection) {
+		if label := strings.TrimSpace(s.Text()); label != "" {
+			labels = append(labels, label)
+		}
+	})
+	if len(labels) > 0 {
+		set("_labels", labels)
+	}
+	var attachments []map[string]string
+	doc.Find(p.Selectors.Attachments).Each(func(i int, s *goquery.Selection) {
+		attachment := map[string]string{
+			"name": strings.TrimSpace(s.Text()),
+			"url":  resolveURL(p.Domain, nodeGetAttr(s.Get(0), "href")),
+		}
+		size := s.Closest("tr, li").Find(p.Selectors.AttachmentSize).First()
+		if text := strings.TrimSpace(size.Text()); text != "" {
+			attachment["size"] = text
+		}
+		attachments = append(attachments, attachment)
+	})
+	if len(attachments) > 0 {
+		set("_attachments", attachments)
+	}
+	doc.Find(p.Selectors.Version).First().Each(func(i int, s *goquery.Selection) {
+		text := nodeGetAttr(s.Get(0), "data-version")
+		if text == "" {
+			text = s.Text()
+		}
+		if v, ok := parseVersion(text); ok {
+			set("_version", v)
+		}
+	})
+	doc.Find(p.Selectors.LastModified).First().Each(func(i int, s *goquery.Selection) {
+		if p.Omit["_date"] {
+			return
+		}
+		dateText := strings.TrimSpace(s.Text())
+		date, e := parseDate(dateText, time.Now())
+		if e != nil {
+			err = fmt.Errorf("cannot parse modification date: %s", e)
+			return
+		}
+		set("_date", formatDate(date, p.DateFormat))
+	})
+	return err
+}
+
+// mainContent returns the first content root that matches and is not empty,
+// or the whole body if none does.
+func (p *Processor) mainContent(doc *goquery.Document) *goquery.Selection {
+	for _, sel := range p.ContentSelectors {
+		s := doc.Find(sel)
+		if s.Length() > 0 && strings.TrimSpace(s.Text()) != "" {
+			log.Printf("debug: main content matched by %s", sel)
+			return s
+		}
+	}
+	log.Printf("warning: no main content found with selectors %s, using the whole body", strings.Join(p.ContentSelectors, ", "))
+	return doc.Find("body")
+}
+
+// tableRows returns the rows of a table, without the rows of nested tables.
+func tableRows(s *goquery.Selection) *goquery.Selection {
+	return s.ChildrenFiltered("thead, tbody, tfoot").ChildrenFiltered("tr")
+}
+
+// dataGrid reports whether a table has a header row and more than two columns.
+func dataGrid(s *goquery.Selection) bool {
+	header := tableRows(s).First()
+	return header.ChildrenFiltered("th").Length() > 0 && header.ChildrenFiltered("th, td").Length() > 2
+}
+
+// rowCells returns the rendered text of the cells of a table row.
+func (p *Processor) rowCells(ctx context.Context, row *goquery.Selection) ([]string, error) {
+	var (
+		cells []string
+		err   error
+	)
+	row.ChildrenFiltered("th, td").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		var buf bytes.Buffer
+		if err = p.RenderText(ctx, &buf, s.Get(0)); err != nil {
+			err = fmt.Errorf("cannot render cell: %s", err)
+			return false
+		}
+		cells = append(cells, strings.TrimSpace(buf.String()))
+		return true
+	})
+	return cells, err
+}
+
+// formatDate returns t in the layout of a Processor.DateFormat.
+func formatDate(t time.Time, layout string) interface{} {
+	switch layout {
+	case "":
+		return t.Format(time.RFC3339)
+	case "unix":
+		return t.Unix()
+	}
+	return t.Format(layout)
+}
+
+// cellList returns the ul or ol element that is the only content of cell,
+// or nil if cell has other content.
+func cellList(cell *html.Node) *html.Node {
+	var list *html.Node
+	for c := cell.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.CommentNode:
+		case c.Type == html.TextNode && strings.TrimSpace(c.Data) == "":
+		case c.Type == html.ElementNode && (c.Data == "ul" || c.Data == "ol") && list == nil:
+			list = c
+		default:
+			return nil
+		}
+	}
+	return list
+}
+
+// listItems returns the rendered text of the items of list.
+func (p *Processor) listItems(ctx context.Context, list *html.Node) ([]string, error) {
+	items := []string{}
+	for c := list.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.Data != "li" {
+			continue
+		}
+		// Render the content of the item only, without its marker
+		var buf bytes.Buffer
+		for n := c.FirstChild; n != nil; n = n.NextSibling {
+			if err := p.RenderText(ctx, &buf, n); err != nil {
+				return nil, fmt.Errorf("cannot render list item: %s", err)
+			}
+		}
+		items = append(items, strings.TrimSpace(buf.String()))
+	}
+	return items, nil
+}
+
+// twoColumn stores the rows of a table of keys and values. A key without a
+// value is stored with an empty one.
+func (p *Processor) twoColumn(ctx context.Context, s *goquery.Selection, vals *Values) error {
+	var (
+		key    string
+		hasKey bool
+		err    error
+	)
+	tableRows(s).Each(func(i int, s *goquery.Selection) {
+		if err != nil {
+			return
+		}
+		// Rows of header cells only are column headings
+		if s.ChildrenFiltered("td").Length() == 0 {
+			return
+		}
+		s.ChildrenFiltered("th, td").Each(func(i int, s *goquery.Selection) {
+			if err != nil {
+				return
+			}
+			node := s.Get(0)
+			// A value made of a list only is kept as a list of items
+			if list := cellList(node); hasKey && node.Data == "td" && list != nil {
+				var items []string
+				if items, err = p.listItems(ctx, list); err != nil {
+					return
+				}
+				vals.Set(key, items)
+				hasKey = false
+				return
+			}
+			var buf bytes.Buffer
+			if err = p.RenderText(ctx, &buf, node); err != nil {
+				err = fmt.Errorf("cannot render subitem: %s", err)
+				return
+			}
+			data := buf.String()
+			// A header cell is always a key
+			if node.Data == "th" && hasKey {
+				vals.Set(key, "")
+				hasKey = false
+			}
+			if hasKey {
+				vals.Set(key, data)
+				hasKey = false
+				return
+			}
+			key = data
+			hasKey = true
+		})
+		if hasKey {
+			vals.Set(key, "")
+		}
+		key = ""
+		hasKey = false
+	})
+	return err
+}
+
+// tableGroup is the key/value pairs of one table with the heading before it.
+type tableGroup struct {
+	Heading string `json:"heading,omitempty"`
+	Values  Values `json:"values"`
+}
+
+// precedingHeading returns the text of the last heading before s, if any.
+func precedingHeading(s *goquery.Selection) string {
+	const headings = "h1, h2, h3, h4, h5, h6"
+	for ; s.Length() > 0 && !s.Is("body"); s = s.Parent() {
+		if h := s.PrevAllFiltered(headings).First(); h.Length() > 0 {
+			return strings.TrimSpace(h.Text())
+		}
+	}
+	return ""
+}
+
+// multiColumn stores the rows of a table with more than two columns. The first
+// cell of a row is the key and the others are its value: an object keyed by
+// the column headings, or a list if the table has no heading row.
+func (p *Processor) multiColumn(ctx context.Context, s *goquery.Selection, vals *Values) error {
+	var (
+		headings []string
+		err      error
+	)
+	tableRows(s).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		var cells []string
+		if cells, err = p.rowCells(ctx, s); err != nil {
+			return false
+		}
+		if len(cells) == 0 {
+			return true
+		}
+		if s.ChildrenFiltered("td").Length() == 0 {
+			headings = cells
+			return true
+		}
+		if headings == nil {
+			vals.Set(cells[0], cells[1:])
+			return true
+		}
+		value := make(map[string]string)
+		for n, cell := range cells[1:] {
+			name := strconv.Itoa(n + 2)
+			if n+1 < len(headings) && headings[n+1] != "" {
+				name = headings[n+1]
+			}
+			value[name] = cell
+		}
+		vals.Set(cells[0], value)
+		return true
+	})
+	return err
+}
+
+func (p *Processor) writeTableCSV(ctx context.Context, s *goquery.Selection, filename string) error {
+	f, err := os.Create(filepath.Join(p.TablesDir, filename))
+	if err != nil {
+		return fmt.Errorf("cannot create CSV file: %s", err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	tableRows(s).EachWithBreak(func(i int, s *goquery.Selection) bool {
+		var record []string
+		if record, err = p.rowCells(ctx, s); err != nil {
+			return false
+		}
+		err = w.Write(record)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("cannot write CSV: %s", err)
+	}
+	return f.Close()
+}
+
+// pageName returns a filename friendly name for the page described by vals.
+func pageName(vals *Values) string {
+	v, _ := vals.Get("_title")
+	if title, ok := v.(map[string]string); ok {
+		if name := Slug(title["text"]); name != "" {
+			return name
+		}
+	}
+	return "page"
+}
+
+// pageID returns a short hash telling apart pages with the same name: of
+// url if known, or else of the content of doc.
+func pageID(doc *goquery.Document, url string) string {
+	id := []byte(url)
+	if url == "" {
+		html, _ := doc.Html()
+		id = []byte(html)
+	}
+	sum := sha256.Sum256(id)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Extract extracts the metadata of the page read from r.
+func (p *Processor) Extract(ctx context.Context, r io.Reader) (Values, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return Values{}, fmt.Errorf("cannot query document: %s", err)
+	}
+	return p.extract(ctx, doc, "")
+}
+
+// prefetchImages starts downloading the images that will be rendered, so that
+// they are fetched concurrently while the page is rendered in order.
+func (p *Processor) prefetchImages(ctx context.Context, doc *goquery.Document, content *goquery.Selection) {
+	if p.ImageMode == ImagesLink {
+		return
+	}
+	imgs := content.Find(p.Selectors.Tables).Find("img")
+	if p.IncludeBody {
+		imgs = content.Find("img")
+	}
+	if !p.Omit["_cover_image"] {
+		imgs = imgs.AddSelection(doc.Find(p.Selectors.CoverImage).First())
+	}
+	imgs.Each(func(i int, s *goquery.Selection) {
+		if src := nodeGetAttr(s.Get(0), "src"); src != "" {
+			p.Images.Prefetch(ctx, resolveURL(p.Domain, src))
+		}
+	})
+}
+
+// extract extracts the metadata of doc, the page at url if known.
+func (p *Processor) extract(ctx context.Context, doc *goquery.Document, url string) (Values, error) {
+	var err error
+	vals := &Values{}
+	content := p.mainContent(doc)
+	p.prefetchImages(ctx, doc, content)
+	if err := p.metadata(ctx, doc, vals); err != nil {
+		return Values{}, fmt.Errorf("cannot query metadata: %s", err)
+	}
+	var (
+		tables []string
+		groups []tableGroup
+	)
+	content.Find(p.Selectors.Tables).Not("table table").Each(func(i int, s *goquery.Selection) {
+		if err != nil {
+			return
+		}
+		if p.TablesDir != "" && dataGrid(s) {
+			filename := fmt.Sprintf("%s-%s-table%d.csv", pageName(vals), pageID(doc, url), len(tables)+1)
+			if err = p.writeTableCSV(ctx, s, filename); err != nil {
+				err = fmt.Errorf("cannot extract table: %s", err)
+				return
+			}
+			tables = append(tables, filename)
+			return
+		}
+		dst := vals
+		if p.GroupTables {
+			dst = &Values{}
+		}
+		if tableRows(s).First().ChildrenFiltered("th, td").Length() > 2 {
+			err = p.multiColumn(ctx, s, dst)
+		} else {
+			err = p.twoColumn(ctx, s, dst)
+		}
+		if err != nil {
+			err = fmt.Errorf("cannot extract table: %s", err)
+			return
+		}
+		if p.GroupTables && dst.Len() > 0 {
+			groups = append(groups, tableGroup{Heading: precedingHeading(s), Values: *dst})
+		}
+	})
+	if len(tables) > 0 {
+		vals.Set("_tables", tables)
+	}
+	if len(groups) > 0 {
+		vals.Set("_table_groups", groups)
+	}
+	if err == nil && p.links != nil {
+		links := content.Find(p.Selectors.Tables)
+		if p.IncludeBody {
+			links = content
+		}
+		if broken := p.brokenLinks(ctx, links); len(broken) > 0 {
+			vals.Set("_broken_links", broken)
+		}
+	}
+	if err == nil && p.IncludeBody {
+		var body string
+		if body, err = p.body(ctx, content); err != nil {
+			err = fmt.Errorf("cannot render body: %s", err)
+		} else if body != "" {
+			vals.Set("_body", body)
+		}
+	}
+	return *vals, err
+}
+
+// body renders the main content without the metadata tables.
+func (p *Processor) body(ctx context.Context, content *goquery.Selection) (string, error) {
+	content = content.Clone()
+	content.Find(p.Selectors.Tables).Remove()
+	var buf bytes.Buffer
+	for _, node := range content.Nodes {
+		if err := p.RenderText(ctx, &buf, node); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// ProcessPage extracts the metadata of the page read from r as JSON.
+func (p *Processor) ProcessPage(ctx context.Context, r io.Reader) ([]byte, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query document: %s", err)
+	}
+	return p.processDoc(ctx, doc, "")
+}
+
+// processDoc extracts the metadata of doc as JSON, adding the URL it was
+// fetched from as _source_url if not empty.
+func (p *Processor) processDoc(ctx context.Context, doc *goquery.Document, url string) ([]byte, error) {
+	vals, err := p.extract(ctx, doc, url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot extract from supage: %s", err)
+	}
+	if url != "" && !p.Omit["_source_url"] {
+		vals.Set("_source_url", url)
+	}
+	var data []byte
+	if p.Pretty {
+		data, err = json.MarshalIndent(vals, "", "  ")
+	} else {
+		data, err = json.Marshal(vals)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot write JSON: %s", err)
+	}
+	return data, nil
+}
+
+// pageReader returns the content of the page at url and the URL it was
+// redirected to, if any.
+func (p *Processor) pageReader(ctx context.Context, url string) (io.Reader, string, error) {
+	m, err := NewMimedFromURL(ctx, p.Client, url, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return bytes.NewReader(m.data), m.url, nil
+}
+
+func (p *Processor) fileReader(url string) (io.Reader, error) {
+	r, err := os.Open(url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %s", err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load file: %s", err)
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (p *Processor) process(ctx context.Context, c *crawl, out chan<- []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		var pg page
+		select {
+		case next, ok := <-c.pages:
+			if !ok {
+				return
+			}
+			pg = next
+		case <-ctx.Done():
+			return
+		}
+		// Drain the queue without processing
+		if c.stopped() {
+			c.pending.Done()
+			continue
+		}
+		ok := p.processURL(ctx, c, pg, out)
+		c.pending.Done()
+		if !ok {
+			return
+		}
+	}
+}
+
+// processURL processes one page and queues its subpages. It returns false if
+// ctx was cancelled.
+func (p *Processor) processURL(ctx context.Context, c *crawl, pg page, out chan<- []byte) bool {
+	url := pg.url
+	if url == "" {
+		log.Printf("warning: skipping empty URL")
+		return true
+	}
+	// Pages done by a previous run are read again only to find their subpages
+	done := c.isDone(url)
+	if done && pg.depth >= p.Depth {
+		log.Printf("debug: skipping page done by a previous run: %s", url)
+		return true
+	}
+	log.Printf("debug: processing start: %s", url)
+	// The page context also ends when the page takes too long
+	pctx := ctx
+	if p.PageTimeout > 0 {
+		var cancel context.CancelFunc
+		pctx, cancel = context.WithTimeout(ctx, p.PageTimeout)
+		defer cancel()
+	}
+	var (
+		r   io.Reader
+		err error
+		// URL of the page after redirects
+		source = url
+	)
+	if strings.HasPrefix(url, "file://") {
+		r, err = p.fileReader(strings.TrimPrefix(url, "file://"))
+	} else {
+		r, source, err = p.pageReader(pctx, url)
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		log.Printf("error: %s: cannot read page content: %s", url, err)
+		atomic.AddInt64(&p.stats.ReadFailed, 1)
+		return true
+	}
+	// The page might have been processed under the URL it redirects to
+	if visitKey(source) != visitKey(url) {
+		log.Printf("debug: %s: redirected to %s", url, source)
+		if !c.visit(source) {
+			return true
+		}
+	}
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		log.Printf("error: %s: cannot query document: %s", url, err)
+		atomic.AddInt64(&p.stats.ExtractFailed, 1)
+		return true
+	}
+	if pg.depth < p.Depth {
+		for _, sub := range subpageLinks(doc, p.Domain, p.Selectors.Subpages) {
+			c.add(ctx, page{url: sub, depth: pg.depth + 1})
+		}
+	}
+	if done {
+		log.Printf("debug: %s: done by a previous run, subpages queued", url)
+		return true
+	}
+	data, err := p.processDoc(pctx, doc, source)
+	if ctx.Err() != nil {
+		return false
+	}
+	// Images that timed out were replaced, but the page is incomplete
+	if pctx.Err() != nil {
+		log.Printf("error: %s: skipped after the page timeout of %s", url, p.PageTimeout)
+		atomic.AddInt64(&p.stats.ExtractFailed, 1)
+		return true
+	}
+	if err != nil {
+		log.Printf("error: %s: cannot extract from supage: %s", url, err)
+		atomic.AddInt64(&p.stats.ExtractFailed, 1)
+		return true
+	}
+	if p.Schema != nil {
+		if err := validate(p.Schema, data); err != nil {
+			log.Printf("error: %s: record %s", url, err)
+			atomic.AddInt64(&p.stats.Invalid, 1)
+			return true
+		}
+	}
+	log.Printf("debug: processing done: %s", url)
+	if p.MaxPages > 0 {
+		n := atomic.AddInt64(&p.sent, 1)
+		if n > p.MaxPages {
+			log.Printf("debug: %s: discarded after the limit of %d pages", url, p.MaxPages)
+			return true
+		}
+		if n == p.MaxPages {
+			log.Printf("info: limit of %d pages reached", p.MaxPages)
+			c.finish()
+		}
+	}
+	select {
+	case out <- data:
+		atomic.AddInt64(&p.stats.Processed, 1)
+		if p.Checkpoint != nil {
+			if err := p.Checkpoint.Add(url); err != nil {
+				log.Printf("warning: %s", err)
+			}
+		}
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,406 @@
+package extract
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func TestTablesDirUniqueNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := NewProcessor("")
+	p.TablesDir = dir
+	page := func(cell string) string {
+		return `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>A</th><th>B</th><th>C</th></tr>
+<tr><td>` + cell + `</td><td>2</td><td>3</td></tr>
+</table></div></body></html>`
+	}
+	// Untitled pages, twice the same page at two URLs, and a page without URL
+	docs := []struct{ html, url string }{
+		{page("1"), "http://wiki.local/pages/viewpage.action?pageId=1"},
+		{page("1"), "http://wiki.local/pages/viewpage.action?pageId=2"},
+		{page("3"), ""},
+	}
+	seen := make(map[string]bool)
+	for _, d := range docs {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(d.html))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals, err := p.extract(context.Background(), doc, d.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := vals.Get("_tables")
+		tables, _ := v.([]string)
+		if len(tables) != 1 {
+			t.Fatalf("got tables %v, want one", tables)
+		}
+		if seen[tables[0]] {
+			t.Errorf("table %s written twice", tables[0])
+		}
+		seen[tables[0]] = true
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(docs) {
+		t.Errorf("got %d files, want %d", len(files), len(docs))
+	}
+}
+
+func TestListCell(t *testing.T) {
+	page := `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>Owners</th><td><ul><li>alice</li><li>bob</li></ul></td></tr>
+<tr><th>Status</th><td>done</td></tr>
+</table></div></body></html>`
+	vals, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := get(vals, "Owners")
+	if items, ok := owners.([]string); !ok || len(items) != 2 || items[0] != "alice" || items[1] != "bob" {
+		t.Errorf("got Owners %#v, want [alice bob]", owners)
+	}
+	if status := get(vals, "Status"); status != "done" {
+		t.Errorf("got Status %#v, want %q", status, "done")
+	}
+}
+
+// get returns the value of key in vals, ignoring the whitespace around keys
+// and text values.
+func get(vals Values, key string) interface{} {
+	for _, k := range vals.Keys() {
+		if strings.TrimSpace(k) == key {
+			v, _ := vals.Get(k)
+			if s, ok := v.(string); ok {
+				return strings.TrimSpace(s)
+			}
+			return v
+		}
+	}
+	return nil
+}
+
+func TestResolveURL(t *testing.T) {
+	tests := []struct{ domain, href, want string }{
+		{"http://wiki.local", "http://other.local/x", "http://other.local/x"},
+		{"http://wiki.local", "https://other.local/x?a=1", "https://other.local/x?a=1"},
+		{"http://wiki.local", "//cdn.local/img.png", "http://cdn.local/img.png"},
+		{"https://wiki.local", "//cdn.local/img.png", "https://cdn.local/img.png"},
+		{"http://wiki.local", "/display/X", "http://wiki.local/display/X"},
+		{"http://wiki.local/", "/display/X", "http://wiki.local/display/X"},
+		{"http://wiki.local/confluence", "/confluence/display/X", "http://wiki.local/confluence/display/X"},
+		{"http://wiki.local/confluence/", "display/X", "http://wiki.local/confluence/display/X"},
+		{"http://wiki.local", "display/X", "http://wiki.local/display/X"},
+		{"http://wiki.local", "../display/X", "http://wiki.local/display/X"},
+		{"http://wiki.local", "/pages/viewpage.action?pageId=1#top", "http://wiki.local/pages/viewpage.action?pageId=1#top"},
+		{"http://wiki.local", "", ""},
+	}
+	for _, tt := range tests {
+		if got := resolveURL(tt.domain, tt.href); got != tt.want {
+			t.Errorf("resolveURL(%q, %q) = %q, want %q", tt.domain, tt.href, got, tt.want)
+		}
+	}
+}
+
+func TestMainContentFallback(t *testing.T) {
+	page := `<html><body><div id="other"><table class="confluenceTable">
+<tr><th>Status</th><td>done</td></tr>
+</table></div></body></html>`
+	vals, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(vals, "Status"); status != "done" {
+		t.Errorf("got Status %#v, want %q", status, "done")
+	}
+}
+
+func TestDateError(t *testing.T) {
+	page := `<html><body><div class="page-metadata-modification-info">
+<span class="last-modified">sometime</span><span class="last-modified">Jan 2, 2006</span>
+</div><div id="main-content">text</div></body></html>`
+	// Only the first date is parsed, so the error doesn't depend on the others
+	for n := 0; n < 3; n++ {
+		_, err := Extract(strings.NewReader(page))
+		if err == nil || !strings.Contains(err.Error(), `"sometime"`) {
+			t.Fatalf("got error %v, want one about the unknown date", err)
+		}
+	}
+	p := NewProcessor("")
+	p.Omit = map[string]bool{"_date": true}
+	if _, err := p.Extract(context.Background(), strings.NewReader(page)); err != nil {
+		t.Errorf("omitted date parsed: %s", err)
+	}
+}
+
+func TestDateFormat(t *testing.T) {
+	page := `<html><body><div class="page-metadata-modification-info">
+<span class="last-modified">Feb 05, 2019</span></div></body></html>`
+	for layout, want := range map[string]string{
+		"":           `"_date":"2019-02-05T00:00:00Z"`,
+		"unix":       `"_date":1549324800`,
+		"02.01.2006": `"_date":"05.02.2019"`,
+	} {
+		p := NewProcessor("")
+		p.DateFormat = layout
+		data, err := p.ProcessPage(context.Background(), strings.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%q: got %s, want %s", layout, data, want)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	page := `<html><body><div class="page-metadata"><ul>
+<li><a class="label" href="/label/a">ops</a></li><li><a class="label" href="/label/b"> </a></li><li><a class="label" href="/label/c">db</a></li>
+</ul></div></body></html>`
+	vals, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := vals.Get("_labels")
+	if labels, ok := v.([]string); !ok || strings.Join(labels, ",") != "ops,db" {
+		t.Errorf("got labels %#v, want [ops db]", v)
+	}
+	vals, err = Extract(strings.NewReader(`<html><body></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := vals.Get("_labels"); ok {
+		t.Errorf("got labels %#v for a page without", v)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		page string
+		want interface{}
+	}{
+		{`<div class="page-metadata"><span class="version">v. 12</span></div>`, 12},
+		{`<div class="page-metadata"><a class="version">version 3 (current)</a></div>`, 3},
+		{`<meta name="ajs-page-version" data-version="7">`, 7},
+		{`<div class="page-metadata"><span class="version">current</span></div>`, nil},
+	}
+	for _, tt := range tests {
+		vals, err := Extract(strings.NewReader("<html><body>" + tt.page + "</body></html>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := vals.Get("_version"); v != tt.want {
+			t.Errorf("%s: got version %#v, want %#v", tt.page, v, tt.want)
+		}
+	}
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	page := `<html><body><ol id="breadcrumbs">
+<li><a href="/display/X">Home</a></li><li><a href="/display/X/Team"> Team </a></li>
+</ol></body></html>`
+	vals, err := NewProcessor("http://wiki.local").Extract(context.Background(), strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := vals.Get("_breadcrumbs")
+	crumbs, ok := v.([]map[string]string)
+	if !ok || len(crumbs) != 2 {
+		t.Fatalf("got breadcrumbs %#v, want two", v)
+	}
+	want := []map[string]string{
+		{"text": "Home", "url": "http://wiki.local/display/X"},
+		{"text": "Team", "url": "http://wiki.local/display/X/Team"},
+	}
+	for i := range want {
+		if len(crumbs[i]) != 2 || crumbs[i]["text"] != want[i]["text"] || crumbs[i]["url"] != want[i]["url"] {
+			t.Errorf("got breadcrumb %v, want %v", crumbs[i], want[i])
+		}
+	}
+}
+
+func TestHeaderCellKeys(t *testing.T) {
+	page := `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>Field</th><th>Value</th></tr>
+<tr><th>Owner</th><td>alice</td></tr>
+<tr><td>Status</td><td>done</td></tr>
+<tr><td>Due</td><th>Team</th></tr>
+</table></div></body></html>`
+	vals, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The heading row is not a key, a header cell never is a value
+	want := map[string]string{"Owner": "alice", "Status": "done", "Due": "", "Team": ""}
+	if len(vals.Keys()) != len(want) {
+		t.Errorf("got keys %q, want %d", vals.Keys(), len(want))
+	}
+	for k, v := range want {
+		if got := get(vals, k); got != v {
+			t.Errorf("got %s %#v, want %q", k, got, v)
+		}
+	}
+}
+
+func TestLoadSelectors(t *testing.T) {
+	f, err := ioutil.TempFile("", "selectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"title": "h1.page-title", "tables": "table.meta"}`)
+	f.Close()
+	sel, err := LoadSelectors(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.Title != "h1.page-title" || sel.Tables != "table.meta" || sel.Author != DefaultSelectors.Author {
+		t.Errorf("got selectors %+v, want title and tables set, the others by default", sel)
+	}
+	p := NewProcessor("")
+	p.Selectors = sel
+	page := `<html><body><h1 class="page-title">Other theme</h1><div id="main-content"><table class="meta">
+<tr><th>Owner</th><td>alice</td></tr></table></div></body></html>`
+	vals, err := p.Extract(context.Background(), strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := vals.Get("_title")
+	if title, _ := v.(map[string]string); title["text"] != "Other theme" {
+		t.Errorf("got title %v, want the one of the other theme", v)
+	}
+	if owner := get(vals, "Owner"); owner != "alice" {
+		t.Errorf("got Owner %#v, want %q", owner, "alice")
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte(`{"title": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSelectors(f.Name()); err == nil {
+		t.Error("expected an error for the invalid file")
+	}
+}
+
+func TestIncludeBody(t *testing.T) {
+	page := `<html><body><div id="main-content"><p>Intro</p><table class="confluenceTable">
+<tr><th>Owner</th><td>alice</td></tr></table><p>Outro</p></div></body></html>`
+	p := NewProcessor("")
+	p.IncludeBody = true
+	vals, err := p.Extract(context.Background(), strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := vals.Get("_body")
+	if s, _ := body.(string); !strings.Contains(s, "Intro") || !strings.Contains(s, "Outro") || strings.Contains(s, "alice") {
+		t.Errorf("got body %q, want the content without the metadata table", body)
+	}
+	if owner := get(vals, "Owner"); owner != "alice" {
+		t.Errorf("got Owner %#v, want %q", owner, "alice")
+	}
+	if vals, _ := Extract(strings.NewReader(page)); vals.Len() != 1 {
+		t.Errorf("got keys %q without -include-body, want Owner only", vals.Keys())
+	}
+}
+
+func TestAuthorWithoutText(t *testing.T) {
+	info := func(links string) string {
+		return `<html><body><div class="page-metadata-modification-info">` + links + `</div></body></html>`
+	}
+	vals, err := Extract(strings.NewReader(info(`<span class="author"><a href="/anonymous"></a><a href="/~alice">Alice</a></span>`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := vals.Get("_author")
+	if author, _ := v.(map[string]string); author["name"] != "Alice" || author["url"] != "/~alice" {
+		t.Errorf("got author %v, want the first one with a name", v)
+	}
+	vals, err = Extract(strings.NewReader(info(`<span class="author"><a href="/anonymous"> </a></span>`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := vals.Get("_author"); ok {
+		t.Errorf("got author %v for an anonymous edit", v)
+	}
+}
+
+func TestOmit(t *testing.T) {
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	page := `<html><body><h1 id="title-text"><a href="/x">Title</a></h1>
+<div class="page-metadata-modification-info"><span class="author"><a href="/~alice">Alice</a></span><span class="last-modified">sometime</span></div>
+<div class="page-cover-picture"><img src="` + srv.URL + `/cover.gif"></div>
+<div id="main-content">text</div></body></html>`
+	p := NewProcessor("")
+	// An omitted date is not parsed and an omitted cover image not fetched
+	p.Omit = map[string]bool{"_author": true, "_date": true, "_cover_image": true}
+	vals, err := p.Extract(context.Background(), strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(vals.Keys(), ","); got != "_title" {
+		t.Errorf("got keys %s, want _title only", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt64(&hits); n != 0 {
+		t.Errorf("got %d requests, want none", n)
+	}
+}
+
+func TestGroupTables(t *testing.T) {
+	page := `<html><body><div id="main-content">
+<h2>Contacts</h2><table class="confluenceTable"><tr><th>Owner</th><td>alice</td></tr></table>
+<h2>Status</h2><div class="table-wrap"><table class="confluenceTable"><tr><th>State</th><td>done</td></tr></table></div>
+</div></body></html>`
+	p := NewProcessor("")
+	p.GroupTables = true
+	data, err := p.ProcessPage(context.Background(), strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	var groups []struct {
+		Heading string
+		Values  map[string]string
+	}
+	if err := json.Unmarshal(rec["_table_groups"], &groups); err != nil {
+		t.Fatalf("invalid _table_groups in %s: %s", data, err)
+	}
+	want := []struct{ heading, key, value string }{{"Contacts", "Owner", "alice"}, {"Status", "State", "done"}}
+	if len(groups) != len(want) {
+		t.Fatalf("got groups %v, want %d", groups, len(want))
+	}
+	for n, g := range groups {
+		if len(g.Values) != 1 {
+			t.Errorf("got group %q with %v, want one key", g.Heading, g.Values)
+		}
+		for k, v := range g.Values {
+			if g.Heading != want[n].heading || strings.TrimSpace(k) != want[n].key || strings.TrimSpace(v) != want[n].value {
+				t.Errorf("got group %q with %q: %q, want %v", g.Heading, k, v, want[n])
+			}
+		}
+	}
+	// The keys of the tables are only in their group
+	for key := range rec {
+		if strings.TrimSpace(key) == "Owner" || strings.TrimSpace(key) == "State" {
+			t.Errorf("got table key %q outside of _table_groups", key)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds of the buckets for request latencies.
+var DefaultLatencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Histogram counts durations in buckets. It is safe for concurrent use.
+type Histogram struct {
+	bounds []time.Duration
+	// Observations in each bucket, the last one has no upper bound
+	counts []int64
+	// Sum of the observations in nanoseconds
+	sum int64
+}
+
+// NewHistogram returns a Histogram with buckets up to each of the sorted bounds.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds d to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	n := 0
+	for n < len(h.bounds) && d > h.bounds[n] {
+		n++
+	}
+	atomic.AddInt64(&h.counts[n], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// WritePrometheus writes the histogram in the Prometheus text format, in seconds.
+func (h *Histogram) WritePrometheus(w io.Writer, name, help string) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name); err != nil {
+		return err
+	}
+	var count int64
+	for n, bound := range h.bounds {
+		count += atomic.LoadInt64(&h.counts[n])
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound.Seconds(), count); err != nil {
+			return err
+		}
+	}
+	count += atomic.LoadInt64(&h.counts[len(h.bounds)])
+	sum := time.Duration(atomic.LoadInt64(&h.sum))
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n",
+		name, count, name, sum.Seconds(), name, count)
+	return err
+}
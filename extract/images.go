@@ -0,0 +1,516 @@
+package extract
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dullgiulio/wiki-extract-mdata/lru"
+)
+
+// Mimed is a downloaded resource with its MIME type.
+type Mimed struct {
+	mime string
+	data []byte
+	// URL the resource was fetched from, after redirects
+	url string
+}
+
+// NewMimedFromURL downloads the resource at url. If max is positive, resources
+// bigger than max bytes are rejected.
+func NewMimedFromURL(ctx context.Context, client *Client, url string, max int64) (*Mimed, error) {
+	m := &Mimed{}
+	resp, err := client.Get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot GET: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	m.url = resp.Request.URL.String()
+	var body io.Reader = resp.Body
+	// The transport decompresses responses to its own requests only, and
+	// removes the header when it does
+	gzipped := strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip")
+	if gzipped {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress body: %s", err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	if max > 0 {
+		// The length of a compressed body says nothing about the decoded one
+		if !gzipped && resp.ContentLength > max {
+			return nil, fmt.Errorf("body of %d bytes exceeds the limit of %d bytes", resp.ContentLength, max)
+		}
+		body = io.LimitReader(body, max+1)
+	}
+	m.data, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read body: %s", err)
+	}
+	if max > 0 && int64(len(m.data)) > max {
+		return nil, fmt.Errorf("body exceeds the limit of %d bytes", max)
+	}
+	hdr := resp.Header.Get("Content-Type")
+	m.mime, _, err = mime.ParseMediaType(hdr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get mime type: %s", err)
+	}
+	return m, nil
+}
+
+// Size in bytes of the smallest header a valid image of each type can have.
+var minImageSize = map[string]int{
+	"image/png":  33, // signature and IHDR chunk
+	"image/gif":  13, // header and logical screen descriptor
+	"image/jpeg": 4,  // SOI and the start of the next marker
+	"image/bmp":  26, // file header and core info header
+	"image/webp": 12, // RIFF header
+}
+
+// checkImage returns an error if the image is empty or too short to be valid.
+func checkImage(m *Mimed) error {
+	if len(m.data) == 0 {
+		return errors.New("empty image")
+	}
+	if size, ok := minImageSize[m.mime]; ok && len(m.data) < size {
+		return fmt.Errorf("truncated image: %d bytes is too short for %s", len(m.data), m.mime)
+	}
+	return nil
+}
+
+// WriteTo writes the resource as a base64 data URI.
+func (i *Mimed) WriteTo(w io.Writer) (int64, error) {
+	m, err := w.Write([]byte("data:" + i.mime + ";base64,"))
+	if err != nil {
+		return int64(m), err
+	}
+	n := int64(m)
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if m, err = enc.Write(i.data); err != nil {
+		return n + int64(m), err
+	}
+	enc.Close()
+	return n + int64(m), nil
+}
+
+type imgaction int
+
+const (
+	imgInline imgaction = iota
+	imgReference
+	imgSkip
+)
+
+// ImageFilter decides whether a fetched image is inlined, referenced by URL or dropped.
+type ImageFilter struct {
+	// Images bigger than inlineMax bytes are referenced. Zero inlines everything.
+	inlineMax int
+	// Images smaller than skipBelow bytes are dropped.
+	skipBelow int
+	// Allowed MIME types. Empty allows all types.
+	types map[string]struct{}
+}
+
+// NewImageFilter returns a filter referencing images bigger than inlineMax bytes,
+// dropping images smaller than skipBelow bytes and keeping only the MIME types
+// listed in types, or all of them if types is empty.
+func NewImageFilter(inlineMax, skipBelow int, types []string) *ImageFilter {
+	f := &ImageFilter{
+		inlineMax: inlineMax,
+		skipBelow: skipBelow,
+		types:     make(map[string]struct{}),
+	}
+	for _, t := range types {
+		f.types[t] = struct{}{}
+	}
+	return f
+}
+
+func (f *ImageFilter) action(m *Mimed) imgaction {
+	if len(f.types) > 0 {
+		if _, ok := f.types[m.mime]; !ok {
+			return imgSkip
+		}
+	}
+	if len(m.data) < f.skipBelow {
+		return imgSkip
+	}
+	if f.inlineMax > 0 && len(m.data) > f.inlineMax {
+		return imgReference
+	}
+	return imgInline
+}
+
+// DefaultMaxImageBytes is the default size limit of downloaded images.
+const DefaultMaxImageBytes = 10 << 20
+
+// ImageProc downloads and caches images with a pool of workers.
+type ImageProc struct {
+	// Downloads waiting for a worker
+	proc chan func()
+	// mux guards lru, hashes and downloads, which are not safe for
+	// concurrent use. They are only used by fetch and download and never
+	// while holding a worker or waiting for one.
+	mux sync.Mutex
+	lru *lru.Cache
+	// Images by the hash of their content, to share identical images
+	hashes *lru.Cache
+	// Downloads in flight by cache key
+	downloads map[string]*download
+	client    *Client
+	filter    *ImageFilter
+	// CacheDir optionally keeps downloaded images on disk across runs.
+	// Set it before the first call to Get.
+	CacheDir string
+	// MaxBytes is the size limit of downloaded images, zero means no limit.
+	// Set it before the first call to Get.
+	MaxBytes int64
+	// ExtraTypes are MIME types without the image/ prefix accepted as images.
+	// Set it before the first call to Get.
+	ExtraTypes []string
+	// MaxWidth is the width in pixels PNG and JPEG images are scaled down to.
+	// Zero keeps them as they are. Set it before the first call to Get.
+	MaxWidth int
+	// IgnoreParams are query parameters left out of the cache keys, like
+	// the version parameters changing at each render of a page. Set it before
+	// the first call to Get.
+	IgnoreParams []string
+	// TTL is how long cached images are used before being downloaded again.
+	// Zero means they never expire. Set it before the first call to Get.
+	TTL time.Duration
+	// Number of empty or truncated images received
+	broken int64
+	// Number of images downloaded, found in the memory cache or not
+	downloaded int64
+	hits       int64
+	misses     int64
+}
+
+// NewImageProc returns an ImageProc downloading with nworkers workers and
+// caching up to max images.
+func NewImageProc(nworkers, max int, client *Client, filter *ImageFilter) *ImageProc {
+	i := &ImageProc{
+		proc:      make(chan func()),
+		lru:       lru.New(max),
+		hashes:    lru.New(max),
+		client:    client,
+		filter:    filter,
+		downloads: make(map[string]*download),
+		MaxBytes:  DefaultMaxImageBytes,
+	}
+	for n := 0; n < nworkers; n++ {
+		go i.run()
+	}
+	return i
+}
+
+// Get returns the image at url. Only the downloads run on the workers, so
+// waiting for an image fetched by another caller doesn't take up a worker.
+func (i *ImageProc) Get(ctx context.Context, url string) (*Mimed, error) {
+	m, err := i.fetch(ctx, url, true)
+	if err != nil {
+		return nil, err
+	}
+	// Broken images are cached too, they were counted once by download
+	if err := checkImage(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Prefetch starts getting the image at url in the background, so that a later
+// Get finds it cached or already in flight. Only that Get counts as a cache
+// hit or miss.
+func (i *ImageProc) Prefetch(ctx context.Context, url string) {
+	go i.fetch(ctx, url, false)
+}
+
+// do runs fn on a worker and waits for it to return.
+func (i *ImageProc) do(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	select {
+	case i.proc <- func() { fn(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// Common file extensions by MIME type, mime.ExtensionsByType is used for the others.
+var imageExtensions = map[string]string{
+	"image/png":     ".png",
+	"image/jpeg":    ".jpg",
+	"image/gif":     ".gif",
+	"image/svg+xml": ".svg",
+	"image/webp":    ".webp",
+	"image/bmp":     ".bmp",
+}
+
+func imageExtension(mimeType string) string {
+	if ext, ok := imageExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// Save writes m to dir in a file named after the hash of its content and
+// returns the file name. Identical images are written only once.
+func (i *ImageProc) Save(m *Mimed, dir string) (string, error) {
+	sum := sha256.Sum256(m.data)
+	name := hex.EncodeToString(sum[:]) + imageExtension(m.mime)
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return name, nil
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create image file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(m.data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("cannot write image file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("cannot write image file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("cannot store image file: %s", err)
+	}
+	return name, nil
+}
+
+// Broken returns the number of empty or truncated images received.
+func (i *ImageProc) Broken() int64 {
+	return atomic.LoadInt64(&i.broken)
+}
+
+// Downloaded returns the number of images downloaded from the wiki.
+func (i *ImageProc) Downloaded() int64 {
+	return atomic.LoadInt64(&i.downloaded)
+}
+
+// CacheHits returns the number of images found in the memory cache.
+func (i *ImageProc) CacheHits() int64 {
+	return atomic.LoadInt64(&i.hits)
+}
+
+// CacheMisses returns the number of images not found in the memory cache.
+func (i *ImageProc) CacheMisses() int64 {
+	return atomic.LoadInt64(&i.misses)
+}
+
+func (i *ImageProc) run() {
+	for fn := range i.proc {
+		fn()
+	}
+}
+
+// isImageType reports whether resources of MIME type t can be used as images.
+func (i *ImageProc) isImageType(t string) bool {
+	if strings.HasPrefix(t, "image/") {
+		return true
+	}
+	for _, extra := range i.ExtraTypes {
+		if t == extra {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedImage is an image in the LRU cache with the time it was fetched.
+type cachedImage struct {
+	m  *Mimed
+	at time.Time
+}
+
+func (i *ImageProc) expired(at time.Time) bool {
+	return i.TTL > 0 && time.Since(at) > i.TTL
+}
+
+// download is an image download shared by all concurrent requests for its URL.
+type download struct {
+	done chan struct{}
+	m    *Mimed
+	err  error
+	// Callers waiting for the download, which is cancelled when all of them
+	// gave up. Guarded by ImageProc.mux.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// cacheKey returns the key of the image at rawurl in the caches.
+func (i *ImageProc) cacheKey(rawurl string) string {
+	if len(i.IgnoreParams) == 0 {
+		return rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.RawQuery == "" {
+		return rawurl
+	}
+	q := u.Query()
+	for _, p := range i.IgnoreParams {
+		q.Del(p)
+	}
+	u.RawQuery = q.Encode()
+	u.Fragment = ""
+	return u.String()
+}
+
+// fetch returns the image at url from the cache, or waits for its download.
+// Concurrent calls for the same image share one download, which doesn't run
+// under the context of any of them: ctx only limits the wait of this call.
+// The call is counted as a cache hit or miss if count is set.
+func (i *ImageProc) fetch(ctx context.Context, url string, count bool) (*Mimed, error) {
+	key := i.cacheKey(url)
+	i.mux.Lock()
+	if cached, ok := i.lru.Get(key); ok {
+		c := cached.(*cachedImage)
+		if !i.expired(c.at) {
+			i.mux.Unlock()
+			if count {
+				atomic.AddInt64(&i.hits, 1)
+			}
+			return c.m, nil
+		}
+	}
+	if count {
+		atomic.AddInt64(&i.misses, 1)
+	}
+	// Join the download already in flight, if any
+	d, ok := i.downloads[key]
+	if !ok {
+		dctx, cancel := context.WithCancel(context.Background())
+		d = &download{done: make(chan struct{}), cancel: cancel}
+		i.downloads[key] = d
+		go i.download(dctx, d, key, url)
+	}
+	d.waiters++
+	i.mux.Unlock()
+
+	select {
+	case <-d.done:
+		return d.m, d.err
+	case <-ctx.Done():
+		i.mux.Lock()
+		d.waiters--
+		if d.waiters == 0 {
+			// Later calls start over instead of joining the cancelled download
+			d.cancel()
+			if i.downloads[key] == d {
+				delete(i.downloads, key)
+			}
+		}
+		i.mux.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// download runs the download d of the image at url and caches the result.
+func (i *ImageProc) download(ctx context.Context, d *download, key, url string) {
+	defer d.cancel()
+	var at time.Time
+	if err := i.do(ctx, func() { d.m, at, d.err = i.load(ctx, key, url) }); err != nil {
+		d.err = err
+	}
+	var sum [sha256.Size]byte
+	if d.err == nil {
+		sum = contentSum(d.m)
+		if checkImage(d.m) != nil {
+			atomic.AddInt64(&i.broken, 1)
+		}
+	}
+
+	i.mux.Lock()
+	if i.downloads[key] == d {
+		delete(i.downloads, key)
+	}
+	if d.err == nil {
+		// Identical images from different URLs are kept once, as long as
+		// they are served with the same type
+		if same, ok := i.hashes.Get(sum); ok {
+			d.m = same.(*Mimed)
+		} else {
+			i.hashes.Add(sum, d.m)
+		}
+		i.lru.Add(key, &cachedImage{m: d.m, at: at})
+	}
+	i.mux.Unlock()
+	close(d.done)
+}
+
+// contentSum returns the hash of the type and the data of m.
+func contentSum(m *Mimed) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	io.WriteString(h, m.mime+"\x00")
+	h.Write(m.data)
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// load gets the image at url, scaled down if needed, and when it was fetched.
+// The disk cache keeps it under key.
+func (i *ImageProc) load(ctx context.Context, key, url string) (*Mimed, time.Time, error) {
+	m, at, err := i.loadOriginal(ctx, key, url)
+	if err != nil {
+		return nil, at, err
+	}
+	if !i.isImageType(m.mime) {
+		return nil, at, fmt.Errorf("not an image: %s", m.mime)
+	}
+	if i.MaxWidth <= 0 {
+		return m, at, nil
+	}
+	if m, err = downscale(m, i.MaxWidth); err != nil {
+		return nil, at, fmt.Errorf("cannot resize image: %s", err)
+	}
+	return m, at, nil
+}
+
+// loadOriginal gets the image from the disk cache or downloads it.
+func (i *ImageProc) loadOriginal(ctx context.Context, key, url string) (*Mimed, time.Time, error) {
+	disk := diskCache(i.CacheDir)
+	if i.CacheDir != "" {
+		if m, at, ok := disk.get(key); ok && !i.expired(at) {
+			return m, at, nil
+		}
+	}
+	m, err := NewMimedFromURL(ctx, i.client, url, i.MaxBytes)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	atomic.AddInt64(&i.downloaded, 1)
+	if i.CacheDir != "" {
+		if err := disk.put(key, m); err != nil {
+			log.Printf("warning: cannot cache image %s on disk: %s", url, err)
+		}
+	}
+	return m, time.Now(), nil
+}
@@ -0,0 +1,561 @@
+package extract
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// testClient returns a Client for tests. The transport doesn't ask for
+// compressed responses, like a custom transport, so they are not decoded
+// before reaching NewMimedFromURL.
+func testClient() *Client {
+	return &Client{HTTP: &http.Client{Transport: &http.Transport{DisableCompression: true}}}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipServer serves body gzipped with the given content type.
+func gzipServer(t *testing.T, contentType string, body []byte) *httptest.Server {
+	data := gzipped(t, body)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(data)
+	}))
+}
+
+func TestNewMimedFromURLGzip(t *testing.T) {
+	image := append([]byte("GIF89a"), make([]byte, 64)...)
+	srv := gzipServer(t, "image/gif", image)
+	defer srv.Close()
+	for _, max := range []int64{0, DefaultMaxImageBytes} {
+		m, err := NewMimedFromURL(context.Background(), testClient(), srv.URL, max)
+		if err != nil {
+			t.Fatalf("max %d: %s", max, err)
+		}
+		if !bytes.Equal(m.data, image) {
+			t.Errorf("max %d: got %d bytes starting with %q, want the decoded image", max, len(m.data), m.data[:6])
+		}
+	}
+}
+
+func TestNewMimedFromURLGzipLimit(t *testing.T) {
+	// Compresses well below the limit, but decodes above it
+	srv := gzipServer(t, "image/gif", make([]byte, 4096))
+	defer srv.Close()
+	if _, err := NewMimedFromURL(context.Background(), testClient(), srv.URL, 1024); err == nil {
+		t.Error("expected an error for a decoded body over the limit")
+	}
+}
+
+func TestPageReaderGzip(t *testing.T) {
+	page := `<html><body><h1 id="title-text"><a href="/display/X/Page">Page</a></h1></body></html>`
+	srv := gzipServer(t, "text/html; charset=utf-8", []byte(page))
+	defer srv.Close()
+	p := &Processor{Client: testClient()}
+	r, _, err := p.pageReader(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title := doc.Find("#title-text a").Text(); title != "Page" {
+		t.Errorf("got title %q, want %q", title, "Page")
+	}
+}
+
+func TestFetchSharedTimeout(t *testing.T) {
+	image := append([]byte("GIF89a"), make([]byte, 64)...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(image)
+	}))
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	// The first page gives up before the image arrives
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	i.Prefetch(short, srv.URL)
+	time.Sleep(5 * time.Millisecond)
+	m, err := i.Get(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("the timeout of another page failed the download: %s", err)
+	}
+	if !bytes.Equal(m.data, image) {
+		t.Errorf("got %d bytes, want the image", len(m.data))
+	}
+}
+
+func TestFetchAllWaitersGone(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) == 1 {
+			// The first download is abandoned
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(append([]byte("GIF89a"), make([]byte, 64)...))
+	}))
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := i.Get(short, srv.URL); err == nil {
+		t.Fatal("expected the timeout of the only waiter")
+	}
+	// A later call starts a new download instead of joining the cancelled one
+	if _, err := i.Get(context.Background(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchSameDataOtherType(t *testing.T) {
+	data := make([]byte, 64)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/"+r.URL.Path[1:])
+		w.Write(data)
+	}))
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	for _, typ := range []string{"png", "gif"} {
+		m, err := i.Get(context.Background(), srv.URL+"/"+typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.mime != "image/"+typ {
+			t.Errorf("got type %s, want image/%s", m.mime, typ)
+		}
+	}
+}
+
+// imageServer serves a GIF image, counting the requests in hits.
+func imageServer(hits *int64) *httptest.Server {
+	image := append([]byte("GIF89a"), make([]byte, 64)...)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(hits, 1)
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(image)
+	}))
+}
+
+func TestGetCached(t *testing.T) {
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	for n := 0; n < 2; n++ {
+		if _, err := i.Get(context.Background(), srv.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("got %d requests, want 1", hits)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	i.IgnoreParams = []string{"version", "modificationDate"}
+	// Only the other parameters tell images apart
+	for _, query := range []string{"?version=1&api=v2", "?api=v2&version=2&modificationDate=3", "?api=v2#top", "?api=v3"} {
+		if _, err := i.Get(context.Background(), srv.URL+"/logo.png"+query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits != 2 {
+		t.Errorf("got %d requests, want 2", hits)
+	}
+	if key := i.cacheKey("http://wiki.local/logo.png?version=1"); key != "http://wiki.local/logo.png" {
+		t.Errorf("got key %q, want the URL without version", key)
+	}
+}
+
+func TestGetServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	m, err := i.Get(context.Background(), srv.URL)
+	if err == nil {
+		t.Error("expected an error")
+	}
+	if m != nil {
+		t.Errorf("got an image with the error: %v", m)
+	}
+}
+
+func TestGetConcurrent(t *testing.T) {
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	i := NewImageProc(4, 16, testClient(), NewImageFilter(0, 0, nil))
+	var wg sync.WaitGroup
+	ms := make([]*Mimed, 20)
+	for n := range ms {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			m, err := i.Get(context.Background(), srv.URL)
+			if err != nil {
+				t.Error(err)
+			}
+			ms[n] = m
+		}(n)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&hits); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+	for _, m := range ms[1:] {
+		if m != ms[0] {
+			t.Fatal("callers got different images")
+		}
+	}
+}
+
+func TestCachesConcurrent(t *testing.T) {
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	// More images than cache entries, so that they are evicted while other
+	// callers look them up. Run with -race.
+	i := NewImageProc(4, 4, testClient(), NewImageFilter(0, 0, nil))
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for k := 0; k < 20; k++ {
+				url := fmt.Sprintf("%s/image%d.gif", srv.URL, (n+k)%10)
+				if k%5 == 0 {
+					i.Prefetch(context.Background(), url)
+				}
+				if _, err := i.Get(context.Background(), url); err != nil {
+					t.Error(err)
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	if hits, misses := i.CacheHits(), i.CacheMisses(); hits+misses != 200 {
+		t.Errorf("got %d hits and %d misses, want 200 lookups", hits, misses)
+	}
+}
+
+func TestBrokenCountedOnce(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG"))
+	}))
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	for n := 0; n < 3; n++ {
+		if _, err := i.Get(context.Background(), srv.URL); err == nil {
+			t.Fatal("expected an error for the truncated image")
+		}
+	}
+	if n := i.Broken(); n != 1 {
+		t.Errorf("got %d broken images, want 1", n)
+	}
+}
+
+func TestCoverImageUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	p.Client = testClient()
+	p.Images = NewImageProc(1, 16, p.Client, NewImageFilter(0, 0, nil))
+	page := `<html><body><div class="page-cover-picture"><img src="/cover.png"></div>
+<div id="main-content">text</div></body></html>`
+	vals, err := p.Extract(context.Background(), strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := vals.Get("_cover_image"); v != srv.URL+"/cover.png" {
+		t.Errorf("got cover image %v, want its URL", v)
+	}
+	if n := p.Stats().ImagesUnavailable; n != 1 {
+		t.Errorf("got %d images unavailable, want 1", n)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	// A second run finds the image downloaded by the first one on disk
+	for n := 0; n < 2; n++ {
+		i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+		i.CacheDir = dir
+		m, err := i.Get(context.Background(), srv.URL+"/image.gif")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.mime != "image/gif" || len(m.data) != 70 {
+			t.Errorf("run %d: got %s image of %d bytes, want the GIF of 70 bytes", n, m.mime, len(m.data))
+		}
+	}
+	if n := atomic.LoadInt64(&hits); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	url := srv.URL + "/image.gif"
+	get := func(i *ImageProc) {
+		if _, err := i.Get(context.Background(), url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	i.CacheDir = dir
+	i.TTL = time.Hour
+	get(i)
+	get(i)
+	if n := atomic.LoadInt64(&hits); n != 1 {
+		t.Fatalf("got %d requests before the TTL, want 1", n)
+	}
+	// Age the copies in memory and on disk past the TTL
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(diskCache(dir).path(url), old, old); err != nil {
+		t.Fatal(err)
+	}
+	cached, _ := i.lru.Get(url)
+	cached.(*cachedImage).at = old
+	get(i)
+	if n := atomic.LoadInt64(&hits); n != 2 {
+		t.Errorf("got %d requests after the TTL, want 2", n)
+	}
+	// A new run with the fresh copy on disk doesn't download it again
+	i = NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	i.CacheDir = dir
+	i.TTL = time.Hour
+	get(i)
+	if n := atomic.LoadInt64(&hits); n != 2 {
+		t.Errorf("got %d requests with a fresh copy on disk, want 2", n)
+	}
+}
+
+// imagePage is a page with an image in a table value.
+const imagePage = `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>Logo</th><td><img src="/logo.gif"></td></tr>
+</table></div></body></html>`
+
+func TestImagesLink(t *testing.T) {
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	p.Client = testClient()
+	p.Images = NewImageProc(1, 16, p.Client, NewImageFilter(0, 0, nil))
+	p.ImageMode = ImagesLink
+	vals, err := p.Extract(context.Background(), strings.NewReader(imagePage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logo, _ := get(vals, "Logo").(string); !strings.Contains(logo, srv.URL+"/logo.gif") {
+		t.Errorf("got Logo %q, want the URL of the image", logo)
+	}
+	if n := atomic.LoadInt64(&hits); n != 0 {
+		t.Errorf("got %d requests, want none", n)
+	}
+}
+
+func TestImagesDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	p.Client = testClient()
+	p.Images = NewImageProc(1, 16, p.Client, NewImageFilter(0, 0, nil))
+	p.ImageMode = ImagesDownload
+	p.ImageDir = dir
+	// The same image twice is saved once
+	for n := 0; n < 2; n++ {
+		vals, err := p.Extract(context.Background(), strings.NewReader(imagePage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if logo, _ := get(vals, "Logo").(string); !strings.Contains(logo, filepath.ToSlash(dir)+"/") || !strings.Contains(logo, ".gif") {
+			t.Errorf("got Logo %q, want a GIF file in %s", logo, dir)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Size() != 70 {
+		t.Errorf("got files %v, want the image saved once", files)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	body := append([]byte("GIF89a"), make([]byte, 94)...)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(body)
+	}))
+	defer plain.Close()
+	// Without a length, the limit applies while reading the body
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(body[:50])
+		w.(http.Flusher).Flush()
+		w.Write(body[50:])
+	}))
+	defer chunked.Close()
+	for _, url := range []string{plain.URL, chunked.URL} {
+		i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+		i.MaxBytes = 99
+		if _, err := i.Get(context.Background(), url); err == nil {
+			t.Errorf("%s: expected an error for the image over the limit", url)
+		}
+		i = NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+		i.MaxBytes = 100
+		if _, err := i.Get(context.Background(), url); err != nil {
+			t.Errorf("%s: %s", url, err)
+		}
+	}
+}
+
+func TestNotAnImage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Like the login page served instead of an image
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>Log in</body></html>"))
+	}))
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	if _, err := i.Get(context.Background(), srv.URL); err == nil || !strings.Contains(err.Error(), "not an image") {
+		t.Errorf("got error %v, want one for the HTML page", err)
+	}
+	i = NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	i.ExtraTypes = []string{"text/html"}
+	if _, err := i.Get(context.Background(), srv.URL); err != nil {
+		t.Errorf("extra type rejected: %s", err)
+	}
+}
+
+func TestPrefetchCounts(t *testing.T) {
+	var hits int64
+	srv := imageServer(&hits)
+	defer srv.Close()
+	i := NewImageProc(1, 16, testClient(), NewImageFilter(0, 0, nil))
+	// The Get after the prefetch finds the image in flight or cached
+	i.Prefetch(context.Background(), srv.URL)
+	if _, err := i.Get(context.Background(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Get(context.Background(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	// Let the prefetch finish
+	time.Sleep(50 * time.Millisecond)
+	if h, m := i.CacheHits(), i.CacheMisses(); m+h != 2 || h < 1 {
+		t.Errorf("got %d hits and %d misses, want one per Get", h, m)
+	}
+	if n := i.Downloaded(); n != 1 {
+		t.Errorf("got %d downloads, want 1", n)
+	}
+}
+
+func TestImagesConcurrent(t *testing.T) {
+	var (
+		mux      sync.Mutex
+		inFlight int
+		max      int
+	)
+	all := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		inFlight++
+		if inFlight > max {
+			max = inFlight
+		}
+		if inFlight == 3 {
+			close(all)
+		}
+		mux.Unlock()
+		defer func() {
+			mux.Lock()
+			inFlight--
+			mux.Unlock()
+		}()
+		// Each download waits for the others to start
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(append([]byte("GIF89a"), make([]byte, 64)...))
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	p.Client = testClient()
+	p.Images = NewImageProc(3, 16, p.Client, NewImageFilter(0, 0, nil))
+	page := `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>A</th><td><img src="/a.gif"></td></tr>
+<tr><th>B</th><td><img src="/b.gif"></td></tr>
+<tr><th>C</th><td><img src="/c.gif"></td></tr>
+</table></div></body></html>`
+	if _, err := p.Extract(context.Background(), strings.NewReader(page)); err != nil {
+		t.Fatal(err)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if max != 3 {
+		t.Errorf("got %d images downloaded at once, want 3", max)
+	}
+}
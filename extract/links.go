@@ -0,0 +1,93 @@
+package extract
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// linkChecker checks whether links resolve, remembering the results.
+type linkChecker struct {
+	client *Client
+	mux    sync.Mutex
+	// Error for each link checked, nil if it resolves
+	results map[string]error
+}
+
+func newLinkChecker(client *Client) *linkChecker {
+	return &linkChecker{client: client, results: make(map[string]error)}
+}
+
+// check returns an error if link doesn't resolve. Servers not allowing HEAD
+// requests are asked with GET.
+func (lc *linkChecker) check(ctx context.Context, link string) error {
+	lc.mux.Lock()
+	err, ok := lc.results[link]
+	lc.mux.Unlock()
+	if ok {
+		return err
+	}
+	resp, err := lc.client.Head(ctx, link)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		resp, err = lc.client.Get(ctx, link)
+	}
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			err = fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+	}
+	// Don't remember links that could not be checked
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	lc.mux.Lock()
+	lc.results[link] = err
+	lc.mux.Unlock()
+	return err
+}
+
+// internal reports whether link points to the wiki at domain.
+func internal(domain, link string) bool {
+	d, err := url.Parse(domain)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && strings.EqualFold(u.Host, d.Host)
+}
+
+// brokenLinks returns the internal links in s that do not resolve, each once.
+func (p *Processor) brokenLinks(ctx context.Context, s *goquery.Selection) []string {
+	var broken []string
+	seen := make(map[string]bool)
+	s.Find("a").Each(func(i int, s *goquery.Selection) {
+		href := nodeGetAttr(s.Get(0), "href")
+		if href == "" || strings.HasPrefix(href, "#") {
+			return
+		}
+		link := resolveURL(p.Domain, href)
+		if seen[link] || !internal(p.Domain, link) {
+			return
+		}
+		seen[link] = true
+		if err := p.links.check(ctx, link); err != nil && ctx.Err() == nil {
+			log.Printf("warning: broken link %s: %s", link, err)
+			broken = append(broken, link)
+		}
+	})
+	return broken
+}
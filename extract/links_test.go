@@ -0,0 +1,52 @@
+package extract
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBrokenLinks(t *testing.T) {
+	var gone int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			atomic.AddInt32(&gone, 1)
+			http.NotFound(w, r)
+		case "/nohead":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}
+	}))
+	defer srv.Close()
+	page := `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>Docs</th><td><a href="/ok">ok</a> <a href="/gone">gone</a> <a href="/nohead">no HEAD</a></td></tr>
+<tr><th>Links</th><td><a href="/gone">again</a> <a href="#top">top</a> <a href="http://other.local/gone">elsewhere</a></td></tr>
+</table></div></body></html>`
+	p := NewProcessor(srv.URL)
+	p.CheckLinks()
+	for n := 0; n < 2; n++ {
+		data, err := p.ProcessPage(context.Background(), strings.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec struct {
+			Broken []string `json:"_broken_links"`
+		}
+		if err := json.Unmarshal(data, &rec); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Broken) != 1 || rec.Broken[0] != srv.URL+"/gone" {
+			t.Errorf("got broken links %v, want only %s/gone", rec.Broken, srv.URL)
+		}
+	}
+	// Links are checked once for all pages
+	if n := atomic.LoadInt32(&gone); n != 1 {
+		t.Errorf("got %d requests for the broken link, want 1", n)
+	}
+}
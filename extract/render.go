@@ -0,0 +1,283 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Renderer decides the markup written around elements by RenderText.
+type Renderer interface {
+	// decorate returns what to write before and after the children of an element node.
+	decorate(ctx context.Context, p *Processor, node *html.Node) (before, after io.WriterTo)
+	// image wraps the source of an embedded or referenced image.
+	image(src io.WriterTo) io.WriterTo
+	// expand delimits the title and rendered body of an expand macro.
+	expand(title, body string) string
+	// pre delimits preformatted text, kept as it is.
+	pre(text string) string
+	// emphasis returns the mark around the content of an emphasis element,
+	// or "" to render the element like any other.
+	emphasis(node *html.Node) string
+}
+
+// NewRenderer returns the Renderer for format, text or markdown.
+func NewRenderer(format string) (Renderer, bool) {
+	switch format {
+	case "text":
+		return TextRenderer{}, true
+	case "markdown":
+		return MarkdownRenderer{}, true
+	}
+	return nil, false
+}
+
+// hasAncestor reports whether any ancestor of node is one of the named elements.
+func hasAncestor(node *html.Node, names ...string) bool {
+	for n := node.Parent; n != nil; n = n.Parent {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		for _, name := range names {
+			if n.Data == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasClass reports whether node has class in its class attribute.
+func hasClass(node *html.Node, class string) bool {
+	for _, c := range strings.Fields(nodeGetAttr(node, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// findClass returns the first descendant of node with class, or nil.
+func findClass(node *html.Node, class string) *html.Node {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && hasClass(c, class) {
+			return c
+		}
+		if n := findClass(c, class); n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// rawText returns the text inside node without changing its whitespace.
+func rawText(node *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+		case n.Type == html.ElementNode && n.Data == "br":
+			b.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+	return b.String()
+}
+
+// itemNumber returns the number of a list item in an ordered list, or false if
+// the item is not in an ordered list. Numbering restarts at each list.
+func itemNumber(node *html.Node) (int, bool) {
+	if node.Parent == nil || node.Parent.Type != html.ElementNode || node.Parent.Data != "ol" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(nodeGetAttr(node.Parent, "start"))
+	if err != nil {
+		n = 1
+	}
+	for s := node.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type == html.ElementNode && s.Data == "li" {
+			n++
+		}
+	}
+	return n, true
+}
+
+// listDepth returns the number of lists node is in.
+func listDepth(node *html.Node) int {
+	depth := 0
+	for n := node.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && (n.Data == "ul" || n.Data == "ol") {
+			depth++
+		}
+	}
+	return depth
+}
+
+// endsWithList reports whether the last content of a list item is a nested
+// list, which already ends the line.
+func endsWithList(node *html.Node) bool {
+	for c := node.LastChild; c != nil; c = c.PrevSibling {
+		if c.Type == html.TextNode && strings.TrimSpace(c.Data) == "" {
+			continue
+		}
+		return c.Type == html.ElementNode && (c.Data == "ul" || c.Data == "ol")
+	}
+	return false
+}
+
+// escapedTo writes src escaped to be an HTML attribute value.
+type escapedTo struct {
+	src io.WriterTo
+}
+
+func (e escapedTo) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if _, err := e.src.WriteTo(&buf); err != nil {
+		return 0, err
+	}
+	n, err := io.WriteString(w, html.EscapeString(buf.String()))
+	return int64(n), err
+}
+
+// TextRenderer renders mostly plain text, keeping links and images as HTML.
+type TextRenderer struct{}
+
+func (TextRenderer) decorate(ctx context.Context, p *Processor, node *html.Node) (before, after io.WriterTo) {
+	switch node.Data {
+	case "li":
+		indent := strings.Repeat("\t", listDepth(node))
+		before = byteTo([]byte(indent + "* "))
+		if n, ok := itemNumber(node); ok {
+			before = byteTo([]byte(indent + strconv.Itoa(n) + ". "))
+		}
+		if !endsWithList(node) {
+			after = byteTo([]byte("\n"))
+		}
+	case "ul", "ol":
+		// A nested list starts on its own line
+		if hasAncestor(node, "li") {
+			before = byteTo([]byte("\n"))
+		} else {
+			after = byteTo([]byte(" "))
+		}
+	case "br":
+		before = byteTo([]byte("\n"))
+	case "a":
+		href := nodeGetAttr(node, "href")
+		if href != "" {
+			before = byteTo([]byte(" <a href=\"" + html.EscapeString(resolveURL(p.Domain, href)) + "\">"))
+			after = byteTo([]byte("</a> "))
+		}
+	case "img":
+		src := nodeGetAttr(node, "src")
+		if src != "" {
+			before = p.image(ctx, resolveURL(p.Domain, src))
+		}
+	default:
+		after = byteTo([]byte(" "))
+	}
+	return before, after
+}
+
+func (TextRenderer) image(src io.WriterTo) io.WriterTo {
+	return &wrapTo{before: "<img src=\"", src: escapedTo{src}, after: "\" />"}
+}
+
+// MarkdownRenderer renders Markdown.
+type MarkdownRenderer struct{}
+
+func (MarkdownRenderer) decorate(ctx context.Context, p *Processor, node *html.Node) (before, after io.WriterTo) {
+	switch node.Data {
+	case "li":
+		indent := strings.Repeat("    ", listDepth(node)-1)
+		before = byteTo([]byte(indent + "- "))
+		if n, ok := itemNumber(node); ok {
+			before = byteTo([]byte(indent + strconv.Itoa(n) + ". "))
+		}
+		if !endsWithList(node) {
+			after = byteTo([]byte("\n"))
+		}
+	case "ul", "ol":
+		// A nested list starts on its own line
+		if hasAncestor(node, "li") {
+			before = byteTo([]byte("\n"))
+		} else {
+			after = byteTo([]byte(" "))
+		}
+	case "br":
+		before = byteTo([]byte("\n"))
+	case "a":
+		href := nodeGetAttr(node, "href")
+		if href != "" {
+			before = byteTo([]byte(" ["))
+			after = byteTo([]byte("](" + resolveURL(p.Domain, href) + ") "))
+		}
+	case "img":
+		src := nodeGetAttr(node, "src")
+		if src != "" {
+			before = p.image(ctx, resolveURL(p.Domain, src))
+		}
+	case "code":
+		before = byteTo([]byte(" `"))
+		after = byteTo([]byte("` "))
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level := int(node.Data[1] - '0')
+		before = byteTo([]byte("\n" + strings.Repeat("#", level) + " "))
+		after = byteTo([]byte("\n"))
+	default:
+		after = byteTo([]byte(" "))
+	}
+	return before, after
+}
+
+func (MarkdownRenderer) image(src io.WriterTo) io.WriterTo {
+	return &wrapTo{before: "![](", src: src, after: ")"}
+}
+
+func (TextRenderer) expand(title, body string) string {
+	return "\n[" + title + "]\n" + body + "\n[/" + title + "]\n"
+}
+
+func (MarkdownRenderer) expand(title, body string) string {
+	var b strings.Builder
+	b.WriteString("\n> **" + title + "**\n>\n")
+	for _, line := range strings.Split(body, "\n") {
+		b.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+	}
+	return b.String()
+}
+
+func (TextRenderer) emphasis(node *html.Node) string {
+	return ""
+}
+
+func (MarkdownRenderer) emphasis(node *html.Node) string {
+	switch node.Data {
+	case "strong", "b":
+		if !hasAncestor(node, "strong", "b") {
+			return "**"
+		}
+	case "em", "i":
+		if !hasAncestor(node, "em", "i") {
+			return "*"
+		}
+	}
+	return ""
+}
+
+func (TextRenderer) pre(text string) string {
+	return "\n" + text + "\n"
+}
+
+func (MarkdownRenderer) pre(text string) string {
+	return "\n```\n" + strings.TrimSuffix(text, "\n") + "\n```\n"
+}
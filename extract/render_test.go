@@ -0,0 +1,188 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// render returns the fragment rendered with r, without the blank lines and
+// spaces around it.
+func render(t *testing.T, r Renderer, fragment string) string {
+	doc, err := html.Parse(strings.NewReader("<html><body>" + fragment + "</body></html>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := doc.FirstChild.LastChild
+	p := NewProcessor("")
+	p.Render = r
+	var buf bytes.Buffer
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		if err := p.RenderText(context.Background(), &buf, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.Trim(buf.String(), " \n")
+}
+
+func TestMarkdownEmphasis(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"<strong>bold</strong>", "**bold**"},
+		{"<em>it</em>", "*it*"},
+		{"<strong><em>both</em></strong>", "***both***"},
+		{"<strong><span>x</span></strong>", "**x**"},
+		{"<b> spaced </b>", "**spaced**"},
+		{"<strong><b>nested</b></strong>", "**nested**"},
+		{"a<strong></strong>b", "a b"},
+	}
+	for _, tt := range tests {
+		if got := render(t, MarkdownRenderer{}, tt.in); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNestedOrderedList(t *testing.T) {
+	in := "<ol><li>a<ol><li>b</li><li>c</li></ol></li><li>d</li></ol>"
+	if got, want := render(t, MarkdownRenderer{}, in), "1. a\n    1. b\n    2. c\n2. d"; got != want {
+		t.Errorf("markdown: got %q, want %q", got, want)
+	}
+	if got, want := render(t, TextRenderer{}, in), "\t1. a\n\t\t1. b\n\t\t2. c\n\t2. d"; got != want {
+		t.Errorf("text: got %q, want %q", got, want)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestRenderGolden renders testdata/*.html in each format and compares the
+// result with the .txt and .md golden files. Run with -update to rewrite them.
+func TestRenderGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		in, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ext, r := range map[string]Renderer{".txt": TextRenderer{}, ".md": MarkdownRenderer{}} {
+			golden := strings.TrimSuffix(file, ".html") + ext
+			got := render(t, r, string(in)) + "\n"
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("%s: got\n%s\nwant\n%s", golden, got, want)
+			}
+		}
+	}
+}
+
+func TestNestedTable(t *testing.T) {
+	page := `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>Hosts</th><td><table><tbody><tr><th>name</th><th>ip</th></tr><tr><td>db</td><td>10.0.0.1</td></tr></tbody></table></td></tr>
+</table></div></body></html>`
+	vals, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(vals, "Hosts"), "| name | ip |\n| db | 10.0.0.1 |"; got != want {
+		t.Errorf("got Hosts %q, want %q", got, want)
+	}
+	if len(vals.Keys()) != 1 {
+		t.Errorf("got keys %q, want the rows of the nested table kept in Hosts", vals.Keys())
+	}
+}
+
+func TestSkipScriptsAndComments(t *testing.T) {
+	in := `<p>before<script>var x = "<b>";</script><style>p { color: red }</style><!-- note -->after</p>`
+	for _, r := range []Renderer{TextRenderer{}, MarkdownRenderer{}} {
+		if got := render(t, r, in); got != "beforeafter" {
+			t.Errorf("%T: got %q, want %q", r, got, "beforeafter")
+		}
+	}
+}
+
+func TestEscapeAttributes(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"a&nbsp;b", "a b"},
+		{`<a href="/x?a=1&b=&quot;2&quot;">link</a>`, `<a href="http://wiki.local/x?a=1&amp;b=&#34;2&#34;">link</a>`},
+	}
+	for _, tt := range tests {
+		doc, err := html.Parse(strings.NewReader("<html><body>" + tt.in + "</body></html>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewProcessor("http://wiki.local")
+		var buf bytes.Buffer
+		if err := p.RenderText(context.Background(), &buf, doc); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(buf.String()); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	// Image sources are escaped too
+	var buf bytes.Buffer
+	if _, err := (TextRenderer{}).image(byteTo(`http://wiki.local/i.png?a=1&b="2"`)).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), `<img src="http://wiki.local/i.png?a=1&amp;b=&#34;2&#34;" />`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	in := `before<div class="expand-container"><div class="expand-control"><span class="expand-control-text">Details</span></div>` +
+		`<div class="expand-content"><p>hidden</p></div></div>after`
+	tests := []struct {
+		r    Renderer
+		want string
+	}{
+		{TextRenderer{}, "before\n[Details]\nhidden\n[/Details]\nafter"},
+		{MarkdownRenderer{}, "before\n> **Details**\n>\n> hidden\nafter"},
+	}
+	for _, tt := range tests {
+		if got := render(t, tt.r, in); got != tt.want {
+			t.Errorf("%T: got %q, want %q", tt.r, got, tt.want)
+		}
+	}
+	// Without a title, the block is still delimited
+	untitled := `<div class="expand-container"><div class="expand-content">hidden</div></div>`
+	if got, want := render(t, TextRenderer{}, untitled), "[Details]\nhidden\n[/Details]"; got != want {
+		t.Errorf("untitled: got %q, want %q", got, want)
+	}
+}
+
+func TestPre(t *testing.T) {
+	in := "<pre>for x in a b; do\n    echo  $x\ndone\n</pre>"
+	tests := []struct {
+		r    Renderer
+		want string
+	}{
+		{TextRenderer{}, "for x in a b; do\n    echo  $x\ndone"},
+		{MarkdownRenderer{}, "```\nfor x in a b; do\n    echo  $x\ndone\n```"},
+	}
+	for _, tt := range tests {
+		if got := render(t, tt.r, in); got != tt.want {
+			t.Errorf("%T: got %q, want %q", tt.r, got, tt.want)
+		}
+	}
+	if got, want := render(t, MarkdownRenderer{}, "<code>make test</code>"), "`make test`"; got != want {
+		t.Errorf("inline code: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+// downscale returns m with its raster image scaled down to maxWidth pixels
+// wide, keeping the aspect ratio. Other images and narrower ones are returned
+// unchanged.
+func downscale(m *Mimed, maxWidth int) (*Mimed, error) {
+	var decode func([]byte) (image.Image, error)
+	var encode func(*bytes.Buffer, image.Image) error
+	switch m.mime {
+	case "image/png":
+		decode = func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) }
+		encode = func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) }
+	case "image/jpeg":
+		decode = func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) }
+		encode = func(w *bytes.Buffer, img image.Image) error { return jpeg.Encode(w, img, nil) }
+	default:
+		return m, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(m.data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %s", err)
+	}
+	if cfg.Width <= maxWidth {
+		return m, nil
+	}
+	img, err := decode(m.data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, scale(img, maxWidth)); err != nil {
+		return nil, fmt.Errorf("cannot encode image: %s", err)
+	}
+	return &Mimed{mime: m.mime, data: buf.Bytes()}, nil
+}
+
+// scale resizes img to width pixels, averaging the source pixels covered by
+// each destination pixel.
+func scale(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,52 @@
+package extract
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testPNG(t *testing.T, width, height int) *Mimed {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return &Mimed{mime: "image/png", data: buf.Bytes()}
+}
+
+func TestDownscale(t *testing.T) {
+	m, err := downscale(testPNG(t, 100, 50), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(m.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+		t.Errorf("got %dx%d, want 20x10", b.Dx(), b.Dy())
+	}
+	if r, _, _, a := img.At(5, 5).RGBA(); r>>8 != 200 || a>>8 != 255 {
+		t.Errorf("got color %v, want the average of the source pixels", img.At(5, 5))
+	}
+	// Narrower images and other types are kept as they are
+	narrow := testPNG(t, 10, 10)
+	if got, err := downscale(narrow, 20); err != nil || got != narrow {
+		t.Errorf("narrower image changed: %v", err)
+	}
+	gif := &Mimed{mime: "image/gif", data: []byte("GIF89a")}
+	if got, err := downscale(gif, 20); err != nil || got != gif {
+		t.Errorf("GIF image changed: %v", err)
+	}
+	if _, err := downscale(&Mimed{mime: "image/png", data: []byte("\x89PNG")}, 20); err == nil {
+		t.Error("expected an error for the truncated image")
+	}
+}
@@ -0,0 +1,38 @@
+package extract
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// LoadSchema reads the JSON Schema that records must match from filename.
+func LoadSchema(filename string) (*gojsonschema.Schema, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find schema: %s", err)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(abs)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load schema: %s", err)
+	}
+	return schema, nil
+}
+
+// validate returns an error listing the ways record doesn't match schema.
+func validate(schema *gojsonschema.Schema, record []byte) error {
+	res, err := schema.Validate(gojsonschema.NewBytesLoader(record))
+	if err != nil {
+		return fmt.Errorf("cannot validate: %s", err)
+	}
+	if res.Valid() {
+		return nil
+	}
+	errs := make([]string, len(res.Errors()))
+	for i, e := range res.Errors() {
+		errs[i] = e.String()
+	}
+	return fmt.Errorf("does not match the schema: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,46 @@
+package extract
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "record.json")
+	schema := `{"type": "object", "required": ["_title"],
+		"properties": {"_title": {"properties": {"text": {"pattern": "^/valid$"}}}}}`
+	if err := ioutil.WriteFile(filename, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><body><h1 id="title-text"><a href="%s">%s</a></h1></body></html>`, r.URL.Path, r.URL.Path)
+	}))
+	defer srv.Close()
+	p := NewProcessor(srv.URL)
+	if p.Schema, err = LoadSchema(filename); err != nil {
+		t.Fatal(err)
+	}
+	titles := run(p, srv.URL+"/valid", srv.URL+"/invalid")
+	if len(titles) != 1 || titles[0] != "/valid" {
+		t.Errorf("got pages %v, want only the one matching the schema", titles)
+	}
+	if s := p.Stats(); s.Invalid != 1 || s.Processed != 1 {
+		t.Errorf("got stats %+v, want 1 processed and 1 invalid", s)
+	}
+}
+
+func TestLoadSchemaMissing(t *testing.T) {
+	if _, err := LoadSchema(filepath.Join("testdata", "missing.json")); err == nil {
+		t.Error("got no error loading a missing schema")
+	}
+}
@@ -0,0 +1,58 @@
+package extract
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Selectors locate the parts of a page. The defaults match the Confluence theme.
+type Selectors struct {
+	// Links to the subpages of an index page
+	Subpages string `json:"subpages"`
+	// Anchor with the page title, the first one with text is used
+	Title       string `json:"title"`
+	Emoji       string `json:"emoji"`
+	CoverImage  string `json:"cover_image"`
+	Author      string `json:"author"`
+	Breadcrumbs string `json:"breadcrumbs"`
+	Labels      string `json:"labels"`
+	Version     string `json:"version"`
+	// Links to attachments and, inside the row or item of each, its size
+	Attachments    string `json:"attachments"`
+	AttachmentSize string `json:"attachment_size"`
+	// Element with the last modification date, the first one is used
+	LastModified string `json:"last_modified"`
+	// Tables with metadata inside the main content
+	Tables string `json:"tables"`
+}
+
+// DefaultSelectors are the selectors for pages of Confluence.
+var DefaultSelectors = Selectors{
+	Subpages:       "#page-children a",
+	Title:          "#title-text a",
+	Emoji:          "#title-heading .page-title-emoji",
+	CoverImage:     ".page-cover-picture img",
+	Author:         ".page-metadata-modification-info .author a",
+	Breadcrumbs:    "#breadcrumbs li a",
+	Labels:         ".page-metadata .label",
+	Version:        ".page-metadata .version, [data-version]",
+	Attachments:    ".attachments a.filename",
+	AttachmentSize: ".filesize",
+	LastModified:   ".page-metadata-modification-info .last-modified",
+	Tables:         "table.confluenceTable",
+}
+
+// LoadSelectors reads selectors from a JSON file. Selectors missing from the
+// file keep their default value.
+func LoadSelectors(filename string) (Selectors, error) {
+	sel := DefaultSelectors
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return sel, fmt.Errorf("cannot read selectors: %s", err)
+	}
+	if err := json.Unmarshal(data, &sel); err != nil {
+		return sel, fmt.Errorf("cannot parse selectors: %s", err)
+	}
+	return sel, nil
+}
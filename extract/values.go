@@ -0,0 +1,64 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Values are the metadata extracted from a page, in the order they were found.
+// The zero value is empty and ready to use.
+type Values struct {
+	keys []string
+	m    map[string]interface{}
+}
+
+// Set sets the value of key. A new key is added after the existing ones.
+func (v *Values) Set(key string, val interface{}) {
+	if v.m == nil {
+		v.m = make(map[string]interface{})
+	}
+	if _, ok := v.m[key]; !ok {
+		v.keys = append(v.keys, key)
+	}
+	v.m[key] = val
+}
+
+// Get returns the value of key and whether it is set.
+func (v Values) Get(key string) (interface{}, bool) {
+	val, ok := v.m[key]
+	return val, ok
+}
+
+// Keys returns the keys in the order they were first set.
+func (v Values) Keys() []string {
+	return v.keys
+}
+
+// Len returns the number of keys.
+func (v Values) Len() int {
+	return len(v.keys)
+}
+
+// MarshalJSON writes the values as a JSON object, keeping the order of the keys.
+func (v Values) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for n, key := range v.keys {
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(v.m[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,43 @@
+package extract
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValuesOrder(t *testing.T) {
+	var v Values
+	v.Set("Zeta", "1")
+	v.Set("Alpha", []string{"a", "b"})
+	v.Set("Mu", map[string]string{"x": "y"})
+	// Setting a key again keeps its place
+	v.Set("Zeta", "2")
+	if got := strings.Join(v.Keys(), ","); got != "Zeta,Alpha,Mu" {
+		t.Errorf("got keys %s, want Zeta,Alpha,Mu", got)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{"Zeta":"2","Alpha":["a","b"],"Mu":{"x":"y"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestExtractKeyOrder(t *testing.T) {
+	page := `<html><body><h1 id="title-text"><a href="/x">Title</a></h1><div id="main-content"><table class="confluenceTable">
+<tr><th>Zeta</th><td>1</td></tr><tr><th>Alpha</th><td>2</td></tr><tr><th>Mu</th><td>3</td></tr>
+</table></div></body></html>`
+	vals, err := Extract(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, k := range vals.Keys() {
+		keys = append(keys, strings.TrimSpace(k))
+	}
+	if got := strings.Join(keys, ","); got != "_title,Zeta,Alpha,Mu" {
+		t.Errorf("got keys %s, want them in page order", got)
+	}
+}
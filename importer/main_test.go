@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the command instead of the tests when started by a test.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("WIKI_IMPORTER_ARGS"); args != "" {
+		os.Args = append([]string{"importer"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestImportStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "importer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stdin, err := os.Open(filepath.Join("..", "dbimport", "testdata", "pages.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	dsn := filepath.Join(dir, "wiki.db")
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "WIKI_IMPORTER_ARGS="+strings.Join([]string{"-driver", "sqlite", "-dsn", dsn}, "\n"))
+	cmd.Stdin = stdin
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM "entries"`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d entries, want the 2 pages read from stdin", n)
+	}
+}
@@ -0,0 +1,77 @@
+// Package loglevel filters the messages of a log.Logger by their level.
+//
+// The level of a message is given by its prefix: "debug:", "info:", "warning:"
+// or "error:". Messages without one, like those of log.Fatal, are always written.
+package loglevel
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var prefixes = []struct {
+	prefix string
+	level  Level
+}{
+	{"debug:", Debug},
+	{"info:", Info},
+	{"warning:", Warn},
+	{"error:", Error},
+}
+
+// Parse returns the level called name: debug, info, warn or error.
+func Parse(name string) (Level, bool) {
+	switch name {
+	case "debug":
+		return Debug, true
+	case "info":
+		return Info, true
+	case "warn", "warning":
+		return Warn, true
+	case "error":
+		return Error, true
+	}
+	return 0, false
+}
+
+// Writer writes the messages at or above its level to the underlying writer,
+// each preceded by the date and time. Use it with log.SetFlags(0), as the level
+// prefix must be at the beginning of each message.
+type Writer struct {
+	w   io.Writer
+	min Level
+}
+
+// NewWriter returns a Writer writing to w the messages at level min or above.
+func NewWriter(w io.Writer, min Level) *Writer {
+	return &Writer{w: w, min: min}
+}
+
+// Write writes the message in p unless it is below the level of w. The log
+// package calls Write once for each message.
+func (w *Writer) Write(p []byte) (int, error) {
+	for _, lp := range prefixes {
+		if bytes.HasPrefix(p, []byte(lp.prefix)) {
+			if lp.level < w.min {
+				return len(p), nil
+			}
+			break
+		}
+	}
+	ts := time.Now().Format("2006/01/02 15:04:05 ")
+	if _, err := io.WriteString(w.w, ts); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
@@ -0,0 +1,65 @@
+package loglevel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		min     Level
+		message string
+		written bool
+	}{
+		{Debug, "debug: x", true},
+		{Info, "debug: x", false},
+		{Info, "info: x", true},
+		{Warn, "info: x", false},
+		{Warn, "warning: x", true},
+		{Error, "warning: x", false},
+		{Error, "error: x", true},
+		// Messages without a level are always written
+		{Error, "cannot open file", true},
+		// Only a prefix at the beginning gives the level
+		{Warn, "deb: x", true},
+		{Warn, "x debug: y", true},
+		{Warn, " debug: x", true},
+		{Warn, "DEBUG: x", true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, tt.min)
+		n, err := w.Write([]byte(tt.message + "\n"))
+		if err != nil || n != len(tt.message)+1 {
+			t.Errorf("%d %q: wrote %d bytes with error %v", tt.min, tt.message, n, err)
+		}
+		if written := strings.HasSuffix(buf.String(), " "+tt.message+"\n"); written != tt.written {
+			t.Errorf("%d %q: got %q, want written %v", tt.min, tt.message, buf.String(), tt.written)
+		}
+		if !tt.written && buf.Len() > 0 {
+			t.Errorf("%d %q: got %q for a dropped message", tt.min, tt.message, buf.String())
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		level Level
+		ok    bool
+	}{
+		{"debug", Debug, true},
+		{"info", Info, true},
+		{"warn", Warn, true},
+		{"warning", Warn, true},
+		{"error", Error, true},
+		{"fatal", 0, false},
+		{"INFO", 0, false},
+	}
+	for _, tt := range tests {
+		if level, ok := Parse(tt.name); level != tt.level || ok != tt.ok {
+			t.Errorf("%q: got %d %v, want %d %v", tt.name, level, ok, tt.level, tt.ok)
+		}
+	}
+}
@@ -1,311 +1,374 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
-	"golang.org/x/net/html"
+	"github.com/dullgiulio/wiki-extract-mdata/dbimport"
+	"github.com/dullgiulio/wiki-extract-mdata/extract"
+	"github.com/dullgiulio/wiki-extract-mdata/loglevel"
+	"golang.org/x/time/rate"
 )
 
-func nodeGetAttr(node *html.Node, attr string) string {
-	for n := range node.Attr {
-		if node.Attr[n].Key == attr {
-			return strings.TrimSpace(node.Attr[n].Val)
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
 		}
 	}
-	return ""
+	return items
 }
 
-func emitSubpages(r io.Reader, domain string, out chan<- string) error {
-	doc, err := goquery.NewDocumentFromReader(r)
+// stdinPiped reports whether stdin is not a terminal.
+func stdinPiped() bool {
+	fi, err := os.Stdin.Stat()
 	if err != nil {
-		close(out)
-		return fmt.Errorf("cannot query document: %s", err)
+		return false
 	}
-	doc.Find("#page-children a").Each(func(i int, s *goquery.Selection) {
-		node := s.Get(0)
-		href := nodeGetAttr(node, "href")
-		if href != "" {
-			out <- domain + href
-		}
-	})
-	close(out)
-	return nil
+	return fi.Mode()&os.ModeCharDevice == 0
 }
 
-type values map[string]interface{}
-
-type byteTo []byte
+// openInput opens the input file, or stdin when filename is "-".
+func openInput(filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(filename)
+}
 
-func (b byteTo) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write([]byte(b))
-	return int64(n), err
+// emitFiles sends to out a file:// URL for each HTML file in dir and its
+// subdirectories, skipping hidden files. It closes out when done.
+func emitFiles(ctx context.Context, dir string, out chan<- string) error {
+	defer close(out)
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() || !strings.EqualFold(filepath.Ext(path), ".html") {
+			return nil
+		}
+		select {
+		case out <- "file://" + path:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
 }
 
-type imageTo struct {
-	img *mimed
+// headerFlag collects the headers given as repeated "Key: Value" flags.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var hs []string
+	for k, vs := range h {
+		for _, v := range vs {
+			hs = append(hs, k+": "+v)
+		}
+	}
+	return strings.Join(hs, ", ")
 }
 
-func (i *imageTo) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write([]byte("<img src=\""))
-	if err != nil {
-		return int64(n), err
+func (h headerFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return fmt.Errorf("header %q is not in the form Key: Value", s)
 	}
-	m, err := i.img.WriteTo(w)
-	m += int64(n)
-	if err != nil {
-		return m, err
+	key := strings.TrimSpace(s[:i])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return fmt.Errorf("invalid header name %q", key)
 	}
-	n, err = w.Write([]byte("\" />"))
-	return m + int64(n), err
+	http.Header(h).Add(key, strings.TrimSpace(s[i+1:]))
+	return nil
 }
 
-type processor struct {
-	domain  string
-	imgproc *imgproc
+// newTransport returns the transport of the requests to the wiki, keeping
+// maxIdle connections open to each host.
+func newTransport(maxIdle int, dialTimeout, keepAlive time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}).DialContext
+	transport.MaxIdleConnsPerHost = maxIdle
+	if transport.MaxIdleConns < maxIdle {
+		transport.MaxIdleConns = maxIdle
+	}
+	return transport
 }
 
-func (p *processor) run(nworkers int, domains <-chan string, out chan<- []byte) {
-	wg := &sync.WaitGroup{}
-	wg.Add(nworkers)
-	for i := 0; i < nworkers; i++ {
-		go p.process(domains, out, wg)
+// regexpFlag collects the regular expressions given as repeated flags.
+type regexpFlag []*regexp.Regexp
+
+func (r *regexpFlag) String() string {
+	var res []string
+	for _, re := range *r {
+		res = append(res, re.String())
 	}
-	wg.Wait()
-	close(out)
+	return strings.Join(res, ", ")
 }
 
-func (p *processor) renderText(w io.Writer, node *html.Node) error {
-	if node == nil {
-		return nil
-	}
-	if node.Type == html.TextNode {
-		data := strings.TrimSpace(node.Data)
-		_, err := w.Write([]byte(data))
+func (r *regexpFlag) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
 		return err
 	}
-	var after, before io.WriterTo
-	if node.Type == html.ElementNode {
-		switch node.Data {
-		case "li":
-			before = byteTo([]byte("\t* "))
-			after = byteTo([]byte("\n"))
-		case "br":
-			before = byteTo([]byte("\n"))
-		case "a":
-			href := nodeGetAttr(node, "href")
-			if href != "" {
-				before = byteTo([]byte(" <a href=\"" + href + "\">"))
-				after = byteTo([]byte("</a> "))
-			}
-		case "img":
-			src := nodeGetAttr(node, "src")
-			if src != "" {
-				img, err := p.imgproc.get(p.domain + src)
-				// Silently skip images we cannot get
-				if err != nil {
-					log.Printf("cannot include image %s: %s", p.domain+src, err)
-					before = byteTo([]byte(" [image unavailable] "))
-				} else {
-					before = &imageTo{img: img}
-				}
+	*r = append(*r, re)
+	return nil
+}
+
+// importer imports each record from in into the database and passes it on to
+// out, which it closes when done. After the database fails, the records are
+// only passed on.
+func importer(in <-chan []byte, out chan<- []byte, im *dbimport.Importer) {
+	failed := false
+	for rec := range in {
+		if !failed {
+			var data map[string]interface{}
+			if err := json.Unmarshal(rec, &data); err != nil {
+				log.Printf("error: cannot import record: %s", err)
+			} else if err := im.ImportRecord(data); err != nil {
+				log.Printf("error: cannot import records, the others are not imported: %s", err)
+				failed = true
 			}
-		default:
-			after = byteTo([]byte(" "))
 		}
+		out <- rec
 	}
-	if before != nil {
-		if _, err := before.WriteTo(w); err != nil {
-			return err
-		}
-	}
-	for node = node.FirstChild; node != nil; node = node.NextSibling {
-		if err := p.renderText(w, node); err != nil {
-			return err
-		}
-	}
-	if after != nil {
-		if _, err := after.WriteTo(w); err != nil {
-			return err
-		}
-	}
-	return nil
+	close(out)
 }
 
-func (p *processor) metadata(doc *goquery.Document, vals map[string]interface{}) error {
+// printer writes each record on its own line, or as elements of a single JSON
+// array if array is set. After the first write error it keeps draining in and
+// reports that error on done.
+func printer(in <-chan []byte, w io.Writer, array bool, done chan<- error) {
+	bw := bufio.NewWriter(w)
 	var err error
-	doc.Find("#title-text a").Each(func(i int, s *goquery.Selection) {
-		node := s.Get(0)
-		href := nodeGetAttr(node, "href")
-		vals["_title"] = map[string]string{
-			"text": node.FirstChild.Data,
-			"url":  p.domain + href,
+	write := func(data []byte) {
+		if err == nil {
+			_, err = bw.Write(data)
 		}
-	})
-	doc.Find(".page-metadata-modification-info .author a").Each(func(i int, s *goquery.Selection) {
-		node := s.Get(0)
-		href := nodeGetAttr(node, "href")
-		vals["_author"] = map[string]string{
-			"name": node.FirstChild.Data,
-			"url":  p.domain + href,
+	}
+	if array {
+		write([]byte("["))
+	}
+	first := true
+	for data := range in {
+		if array && !first {
+			write([]byte(","))
 		}
-	})
-	doc.Find(".page-metadata-modification-info .last-modified").Each(func(i int, s *goquery.Selection) {
-		node := s.Get(0)
-		dateText := node.FirstChild.Data
-		date, e := time.Parse("02 Jan 2006", dateText)
-		if e != nil {
-			err = fmt.Errorf("cannot parse modification date: %s", e)
-			return
+		first = false
+		write(data)
+		if !array {
+			write([]byte("\n"))
 		}
-		vals["_date"] = date.Format(time.RFC3339)
-	})
-	return err
-}
-
-func (p *processor) attributes(r io.Reader) (values, error) {
-	doc, err := goquery.NewDocumentFromReader(r)
-	if err != nil {
-		return nil, fmt.Errorf("cannot query document: %s", err)
 	}
-	vals := make(map[string]interface{})
-	if err := p.metadata(doc, vals); err != nil {
-		return nil, fmt.Errorf("cannot query metadata: %s", err)
+	if array {
+		write([]byte("]\n"))
 	}
-	var key string
-	var hasKey bool
-	doc.Find("#main-content table.confluenceTable").Each(func(i int, s *goquery.Selection) {
-		if err != nil {
-			return
-		}
-		s.Find("tr").Each(func(i int, s *goquery.Selection) {
-			if err != nil {
-				return
-			}
-			s.Find("td").Each(func(i int, s *goquery.Selection) {
-				if err != nil {
-					return
-				}
-				node := s.Get(0)
-				var buf bytes.Buffer
-				if err = p.renderText(&buf, node); err != nil {
-					err = fmt.Errorf("cannot render subitem: %s", err)
-					return
-				}
-				data := buf.String()
-				if hasKey {
-					vals[key] = data
-					hasKey = false
-					return
-				}
-				key = data
-				hasKey = true
-			})
-			if hasKey {
-				vals[key] = ""
-			}
-			key = ""
-			hasKey = false
-		})
-	})
-	return values(vals), err
+	if err == nil {
+		err = bw.Flush()
+	}
+	done <- err
 }
 
-func (p *processor) processPage(r io.Reader) ([]byte, error) {
-	vals, err := p.attributes(r)
-	if err != nil {
-		return nil, fmt.Errorf("cannot extract from supage: %s", err)
+func main() {
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on /metrics at this address, like :9100")
+	logLevel := flag.String("log-level", "debug", "Minimum level of the messages logged: debug, info, warn or error")
+	dryRun := flag.Bool("dry-run", false, "Only print the URLs of the subpages listed in the input that would be extracted, without fetching them")
+	nworkers := flag.Int("workers", 6, "Number of concurrent workers")
+	pageWorkers := flag.Int("page-workers", 0, "Number of workers extracting pages (default -workers)")
+	imageWorkers := flag.Int("image-workers", 0, "Number of workers downloading images (default -workers)")
+	filename := flag.String("input", "OPI.html", "HTML page listing the subpages to extract, directory of HTML pages or - for stdin")
+	domain := flag.String("domain", "http://wiki.local", "Wiki URL prefixed to relative links")
+	checkpoint := flag.String("checkpoint", "", "Skip the pages listed in this file and add to it the pages extracted, to resume interrupted runs")
+	depth := flag.Int("depth", 0, "Also extract the subpages of extracted pages, up to this many levels down")
+	maxLru := flag.Int("cache-size", 256, "Maximum number of images kept in memory")
+	imageCacheDir := flag.String("image-cache-dir", "", "Keep downloaded images in this directory across runs")
+	maxImageWidth := flag.Int("max-image-width", 0, "Scale PNG and JPEG images down to this width in pixels (0 keeps them as they are)")
+	maxImageBytes := flag.Int64("max-image-bytes", extract.DefaultMaxImageBytes, "Skip images bigger than this many bytes (0 for no limit)")
+	imageCacheKey := flag.String("image-cache-key", "", "Comma separated list of query parameters left out when caching images, like version,modificationDate (default the full URL)")
+	imageTTL := flag.Duration("image-ttl", 0, "Download cached images again after this long (0 never expires them)")
+	timeout := flag.Duration("http-timeout", 30*time.Second, "Timeout for each HTTP request")
+	insecure := flag.Bool("insecure", false, "Do not verify the TLS certificate of the wiki")
+	proxy := flag.String("proxy", "", "URL of the HTTP proxy (default from $HTTP_PROXY and $HTTPS_PROXY)")
+	reqRate := flag.Float64("rate", 0, "Maximum number of requests per second to the wiki (0 for no limit)")
+	dialTimeout := flag.Duration("dial-timeout", 10*time.Second, "Timeout for opening connections")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "Interval of TCP keep-alive probes on open connections")
+	maxIdle := flag.Int("max-idle-conns", 0, "Number of idle connections kept open to each host (default the number of page and image workers)")
+	pageTimeout := flag.Duration("page-timeout", 0, "Skip pages taking longer than this to extract, images included (0 for no limit)")
+	retries := flag.Int("retries", 3, "Number of retries for HTTP requests failing with network or server errors")
+	user := flag.String("user", "", "User for HTTP basic auth or -login-url (default $WIKI_USER)")
+	password := flag.String("password", "", "Password for HTTP basic auth or -login-url (default $WIKI_PASSWORD)")
+	loginURL := flag.String("login-url", "", "Log in with -user and -password at this form URL instead of using basic auth")
+	header := headerFlag(make(http.Header))
+	flag.Var(header, "header", "Header sent with every request as \"Key: Value\", can be repeated")
+	userAgent := flag.String("user-agent", "wiki-extract-mdata/1.0", "User-Agent header sent with every request")
+	imagesFlag := flag.String("images", "inline", "How to include images: inline, link or download")
+	imageDir := flag.String("image-dir", "images", "Directory where images are saved with -images=download")
+	inlineMax := flag.Int("inline-max-bytes", 0, "Reference images bigger than this many bytes instead of inlining them (0 inlines all)")
+	skipBelow := flag.Int("skip-below-bytes", 0, "Drop images smaller than this many bytes")
+	imageTypes := flag.String("allowed-image-types", "", "Comma separated list of image MIME types to keep (empty keeps all)")
+	extraTypes := flag.String("extra-image-types", "", "Comma separated list of MIME types without the image/ prefix to accept as images")
+	format := flag.String("format", "text", "Output format: JSON with text or markdown cells, csv or yaml")
+	omit := flag.String("omit", "", "Comma separated list of page metadata keys not to extract, like _author,_date")
+	dateFormat := flag.String("date-format", "", "Go time layout of _date, or unix for seconds since the epoch (default RFC 3339, as the importer expects)")
+	checkLinks := flag.Bool("check-links", false, "Report the links to wiki pages that don't resolve as _broken_links")
+	includeBody := flag.Bool("include-body", false, "Also render the main content without the metadata tables as _body")
+	groupTables := flag.Bool("group-tables", false, "Keep the keys of each table with the heading before it in _table_groups instead of merging them")
+	tablesDir := flag.String("tables-dir", "", "Write data grid tables as CSV files in this directory instead of flattening them")
+	jsonArray := flag.Bool("json-array", false, "Write records as a single JSON array instead of one per line")
+	pretty := flag.Bool("pretty", false, "Indent JSON records; implies -json-array")
+	output := flag.String("output", "", "Write records to this file instead of stdout")
+	outputDir := flag.String("output-dir", "", "Write each page to its own file in this directory instead of stdout")
+	filenameTemplate := flag.String("filename-template", "{{.TitleSlug}}.json", "Template for per-page filenames, relative to -output-dir")
+	importDSN := flag.String("import-dsn", "", "Also import the records into the database with this data source name, configured by the -import-* flags")
+	// The tables are created by default, as there is no other step before
+	importDefaults := dbimport.DefaultOptions
+	importDefaults.InitSchema = true
+	importFlags := dbimport.NewFlags(flag.CommandLine, "import-", importDefaults)
+	var exclude regexpFlag
+	flag.Var(&exclude, "exclude", "Regular expression of URLs not to extract, can be repeated")
+	maxPages := flag.Int64("max-pages", 0, "Stop after extracting this many pages (0 for no limit)")
+	schemaFile := flag.String("schema", "", "JSON Schema file; records not matching it are skipped")
+	schemaStrict := flag.Bool("schema-strict", false, "Exit with an error if any record does not match -schema")
+	selectorsFile := flag.String("selectors", "", "JSON file with the selectors for the parts of a page, for themes other than Confluence's default")
+	contentSelectors := flag.String("content-selectors", strings.Join(extract.DefaultContentSelectors, ","), "Comma separated selectors for the main content, tried in order")
+	flag.Parse()
+
+	level, ok := loglevel.Parse(*logLevel)
+	if !ok {
+		log.Fatalf("unknown log level: %s", *logLevel)
 	}
-	data, err := json.Marshal(vals)
-	if err != nil {
-		return nil, fmt.Errorf("cannot write JSON: %s", err)
+	log.SetFlags(0)
+	log.SetOutput(loglevel.NewWriter(os.Stderr, level))
+	if *user == "" {
+		*user = os.Getenv("WIKI_USER")
 	}
-	return data, nil
-}
-
-func (p *processor) pageReader(url string) (io.Reader, error) {
-	mimed, err := newMimedFromUrl(url)
-	if err != nil {
-		return nil, err
+	if *password == "" {
+		*password = os.Getenv("WIKI_PASSWORD")
 	}
-	return bytes.NewReader(mimed.data), nil
-}
-
-func (p *processor) fileReader(url string) (io.Reader, error) {
-	r, err := os.Open(url)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read file: %s", err)
+	cellFormat := *format
+	if *format == "csv" || *format == "yaml" {
+		cellFormat = "text"
 	}
-	defer r.Close()
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, fmt.Errorf("cannot load file: %s", err)
+	render, ok := extract.NewRenderer(cellFormat)
+	if !ok {
+		log.Fatalf("unknown format: %s", *format)
 	}
-	return bytes.NewReader(data), nil
-}
-
-func (p *processor) process(in <-chan string, out chan<- []byte, wg *sync.WaitGroup) {
-	for url := range in {
-		log.Printf("debug: processing start: %s", url)
-		var (
-			r   io.Reader
-			err error
-		)
-		if url[0:7] == "file://" {
-			r, err = p.fileReader(url[7:])
-		} else {
-			r, err = p.pageReader(url)
+	imageMode, ok := extract.ParseImageMode(*imagesFlag)
+	if !ok {
+		log.Fatalf("unknown image mode: %s", *imagesFlag)
+	}
+	if imageMode == extract.ImagesDownload {
+		if err := os.MkdirAll(*imageDir, 0755); err != nil {
+			log.Fatalf("cannot create image directory: %s", err)
 		}
-		if err != nil {
-			log.Printf("%s: cannot read page content: %s", url, err)
-			continue
+	}
+	if *pageWorkers == 0 {
+		*pageWorkers = *nworkers
+	}
+	if *imageWorkers == 0 {
+		*imageWorkers = *nworkers
+	}
+	if *pageWorkers < 1 || *imageWorkers < 1 {
+		log.Fatal("at least one worker is required")
+	}
+	inputSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "input" {
+			inputSet = true
 		}
-		data, err := p.processPage(r)
-		if err != nil {
-			log.Fatalf("cannot extract from supage: %s", err)
+	})
+	if !inputSet && stdinPiped() {
+		*filename = "-"
+	}
+	if *filename != "-" {
+		if _, err := os.Stat(*filename); err != nil {
+			log.Fatalf("cannot use input: %s", err)
 		}
-		log.Printf("debug: processing done: %s", url)
-		out <- data
 	}
-	wg.Done()
-}
-
-func printer(in <-chan []byte, w io.Writer, done chan<- struct{}) {
-	for data := range in {
-		if _, err := w.Write(data); err != nil {
-			log.Fatalf("cannot write to output: %s", err)
+	selectors := extract.DefaultSelectors
+	if *selectorsFile != "" {
+		var err error
+		if selectors, err = extract.LoadSelectors(*selectorsFile); err != nil {
+			log.Fatal(err)
 		}
-		if _, err := w.Write([]byte("\n")); err != nil {
-			log.Fatalf("cannot write to output: %s", err)
+	}
+	if *schemaStrict && *schemaFile == "" {
+		log.Fatal("-schema-strict requires -schema")
+	}
+	contentRoots := splitList(*contentSelectors)
+	if len(contentRoots) == 0 {
+		log.Fatal("at least one content selector is required")
+	}
+	if *imageCacheDir != "" {
+		if err := os.MkdirAll(*imageCacheDir, 0755); err != nil {
+			log.Fatalf("cannot create image cache directory: %s", err)
+		}
+	}
+	if *tablesDir != "" {
+		if err := os.MkdirAll(*tablesDir, 0755); err != nil {
+			log.Fatalf("cannot create tables directory: %s", err)
 		}
 	}
-	close(done)
-}
 
-func main() {
-	nworkers := 6
-	filename := "OPI.html"
-	domain := "http://wiki.local"
-	maxLru := 256
+	// The first signal stops reading input and starting pages, the pages in
+	// progress are still written out. A second one cancels them too.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("info: %s received, finishing the pages in progress", sig)
+		stop()
+		sig = <-sigs
+		log.Printf("warning: %s received again, stopping now", sig)
+		cancel()
+	}()
 
 	domains := make(chan string, 2048)
 	out := make(chan []byte)
-	done := make(chan struct{})
+	done := make(chan error, 1)
 	go func() {
-		r, err := os.Open(filename)
+		if fi, err := os.Stat(*filename); err == nil && fi.IsDir() {
+			if err := emitFiles(stopCtx, *filename, domains); err != nil && stopCtx.Err() == nil {
+				log.Fatalf("cannot list input directory: %s", err)
+			}
+			return
+		}
+		r, err := openInput(*filename)
 		if err != nil {
 			log.Fatalf("cannot open file: %s", err)
 		}
-		if err := emitSubpages(r, domain, domains); err != nil {
+		if err := extract.EmitSubpages(stopCtx, r, *domain, selectors.Subpages, domains); err != nil && stopCtx.Err() == nil {
 			log.Fatalf("cannot get subpages: %s", err)
 		}
 		r.Close()
@@ -314,11 +377,187 @@ func main() {
 			close(domains)
 		*/
 	}()
-	processor := &processor{
-		domain:  domain,
-		imgproc: newImgproc(nworkers, maxLru),
+	if *dryRun {
+		urls := make(chan string)
+		go extract.Filter(domains, exclude, urls)
+		for url := range urls {
+			fmt.Println(url)
+		}
+		return
+	}
+	// All workers usually talk to the same wiki, keep a connection for each
+	if *maxIdle <= 0 {
+		*maxIdle = *pageWorkers + *imageWorkers
+	}
+	transport := newTransport(*maxIdle, *dialTimeout, *keepAlive)
+	if *proxy != "" {
+		u, err := url.Parse(*proxy)
+		if err != nil {
+			log.Fatalf("invalid proxy URL: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if *insecure {
+		log.Print("warning: TLS certificates are not verified, connections to the wiki are not secure")
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &extract.Client{
+		HTTP:      &http.Client{Timeout: *timeout, Transport: transport},
+		UserAgent: *userAgent,
+		Header:    http.Header(header),
+		Retries:   *retries,
+		Backoff:   200 * time.Millisecond,
+	}
+	if *reqRate > 0 {
+		client.Limiter = rate.NewLimiter(rate.Limit(*reqRate), 1)
+	}
+	if *loginURL != "" {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			log.Fatalf("cannot create cookie jar: %s", err)
+		}
+		client.HTTP.Jar = jar
+		if err := client.Login(ctx, *loginURL, *user, *password); err != nil {
+			log.Fatalf("cannot log in: %s", err)
+		}
+	} else {
+		client.User = *user
+		client.Password = *password
+	}
+	filter := extract.NewImageFilter(*inlineMax, *skipBelow, splitList(*imageTypes))
+	images := extract.NewImageProc(*imageWorkers, *maxLru, client, filter)
+	images.CacheDir = *imageCacheDir
+	images.TTL = *imageTTL
+	images.IgnoreParams = splitList(*imageCacheKey)
+	images.MaxWidth = *maxImageWidth
+	images.MaxBytes = *maxImageBytes
+	images.ExtraTypes = splitList(*extraTypes)
+	processor := &extract.Processor{
+		Domain:           *domain,
+		Client:           client,
+		Render:           render,
+		Images:           images,
+		Selectors:        selectors,
+		ContentSelectors: contentRoots,
+		TablesDir:        *tablesDir,
+		IncludeBody:      *includeBody,
+		Omit:             make(map[string]bool),
+		Pretty:           *pretty,
+		ImageMode:        imageMode,
+		ImageDir:         *imageDir,
+		Depth:            *depth,
+		PageTimeout:      *pageTimeout,
+		DateFormat:       *dateFormat,
+		MaxPages:         *maxPages,
+		GroupTables:      *groupTables,
+		Exclude:          exclude,
+		Stop:             stopCtx.Done(),
+	}
+	if *schemaFile != "" {
+		schema, err := extract.LoadSchema(*schemaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.Schema = schema
+	}
+	if *checkLinks {
+		processor.CheckLinks()
+	}
+	if *checkpoint != "" {
+		cp, err := extract.OpenCheckpoint(*checkpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		processor.Checkpoint = cp
+	}
+	for _, key := range splitList(*omit) {
+		processor.Omit[key] = true
+	}
+	if *metricsAddr != "" {
+		client.Latency = extract.NewHistogram(extract.DefaultLatencyBuckets)
+		serveMetrics(*metricsAddr, &metrics{processor: processor, client: client})
+	}
+	var outFile *os.File
+	if *outputDir != "" {
+		fw, err := newFileWriter(*outputDir, *filenameTemplate)
+		if err != nil {
+			log.Fatalf("cannot write to output directory: %s", err)
+		}
+		go filePrinter(out, fw, done)
+	} else {
+		var w io.Writer = os.Stdout
+		if *output != "" {
+			var err error
+			if outFile, err = os.Create(*output); err != nil {
+				log.Fatalf("cannot create output file: %s", err)
+			}
+			w = outFile
+		}
+		switch *format {
+		case "csv":
+			go csvPrinter(out, w, done)
+		case "yaml":
+			go yamlPrinter(out, w, done)
+		default:
+			// Indented records span multiple lines, only an array keeps them apart
+			go printer(out, w, *jsonArray || *pretty, done)
+		}
+	}
+	var (
+		im         *dbimport.Importer
+		importOpts dbimport.Options
+	)
+	if *importDSN != "" {
+		var err error
+		if importOpts, err = importFlags.Options(*importDSN); err != nil {
+			log.Fatal(err)
+		}
+		if im, err = dbimport.Open(importOpts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if im != nil {
+		records := make(chan []byte)
+		go processor.Run(ctx, *pageWorkers, domains, records)
+		importer(records, out, im)
+	} else {
+		processor.Run(ctx, *pageWorkers, domains, out)
+	}
+	err := <-done
+	var importErr error
+	if im != nil {
+		if importErr = im.Close(); importErr != nil {
+			log.Printf("error: cannot import records: %s", importErr)
+		}
+		importOpts.Policy.Report(importFlags.MaxKeys())
+	}
+	if outFile != nil {
+		if e := outFile.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Printf("error: cannot write to output: %s", err)
+	}
+	if processor.Checkpoint != nil {
+		if err := processor.Checkpoint.Close(); err != nil {
+			log.Printf("warning: cannot close checkpoint: %s", err)
+		}
+	}
+	stats := processor.Stats()
+	log.Printf("info: %d pages extracted, %d could not be read, %d could not be extracted, %d images unavailable",
+		stats.Processed, stats.ReadFailed, stats.ExtractFailed, stats.ImagesUnavailable)
+	if n := processor.Images.Broken(); n > 0 {
+		log.Printf("warning: %d empty or truncated images were not included", n)
+	}
+	if stats.Invalid > 0 {
+		log.Printf("warning: %d records did not match the schema and were skipped", stats.Invalid)
+	}
+	if stopCtx.Err() != nil {
+		log.Print("warning: interrupted")
+	}
+	if err != nil || importErr != nil || stopCtx.Err() != nil || (*schemaStrict && stats.Invalid > 0) {
+		cancel()
+		os.Exit(1)
 	}
-	go printer(out, os.Stdout, done)
-	processor.run(nworkers, domains, out)
-	<-done
 }
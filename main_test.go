@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMain runs the command instead of the tests when started by runMain.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("WIKI_EXTRACT_ARGS"); args != "" {
+		os.Args = append([]string{"wiki-extract-mdata"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args and returns what it wrote to stdout
+// and stderr.
+func runMain(t *testing.T, args ...string) (string, string, error) {
+	return runMainEnv(t, nil, args...)
+}
+
+// runMainEnv is like runMain, adding env to the environment of the command.
+func runMainEnv(t *testing.T, env []string, args ...string) (string, string, error) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Env = append(cmd.Env, "WIKI_EXTRACT_ARGS="+strings.Join(args, "\n"))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// pagesDir returns a temporary directory with an HTML file for each of the
+// pages, named after the keys.
+func pagesDir(t *testing.T, pages map[string]string) string {
+	dir, err := ioutil.TempDir("", "pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, page := range pages {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(page), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPrinterArray(t *testing.T) {
+	for _, records := range [][]string{
+		nil,
+		{`{"a":1}`},
+		{`{"a":1}`, "{\n  \"b\": [2, 3]\n}", `{"c":"x"}`},
+	} {
+		in := make(chan []byte, len(records))
+		for _, rec := range records {
+			in <- []byte(rec)
+		}
+		close(in)
+		var buf bytes.Buffer
+		done := make(chan error, 1)
+		printer(in, &buf, true, done)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		var got []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("%d records: invalid array %q: %s", len(records), buf.String(), err)
+		}
+		if got == nil || len(got) != len(records) {
+			t.Errorf("got %d records %q, want an array of %d", len(got), buf.String(), len(records))
+		}
+	}
+}
+
+func TestOpenInputStdin(t *testing.T) {
+	f, err := ioutil.TempFile("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString("<ul id=\"page-children\"></ul>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = stdin }()
+	r, err := openInput("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "<ul id=\"page-children\"></ul>" {
+		t.Errorf("got %q, want the index written to stdin", data)
+	}
+	if !stdinPiped() {
+		t.Error("a file on stdin is not reported as piped")
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	dir := pagesDir(t, map[string]string{
+		"a.html": `<html><body><h1 id="title-text"><a href="/a">A</a></h1></body></html>`,
+	})
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out", "records.json")
+	if err := os.Mkdir(filepath.Dir(output), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, err := runMain(t, "-input", dir, "-output", output, "-log-level", "error")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("got %q on stdout, want nothing", stdout)
+	}
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"text":"A"`) || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("got output file %q, want the record of A", data)
+	}
+}
+
+func TestPretty(t *testing.T) {
+	dir := pagesDir(t, map[string]string{
+		"a.html": `<html><body><h1 id="title-text"><a href="/a">A</a></h1></body></html>`,
+		"b.html": `<html><body><h1 id="title-text"><a href="/b">B</a></h1></body></html>`,
+	})
+	defer os.RemoveAll(dir)
+	stdout, stderr, err := runMain(t, "-input", dir, "-pretty", "-log-level", "error")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	var records []map[string]interface{}
+	if err := json.Unmarshal([]byte(stdout), &records); err != nil {
+		t.Fatalf("invalid array %q: %s", stdout, err)
+	}
+	if len(records) != 2 {
+		t.Errorf("got %d records, want 2", len(records))
+	}
+	if !strings.Contains(stdout, "\n  \"_title\": {\n    \"text\"") {
+		t.Errorf("got %q, want indented records", stdout)
+	}
+}
+
+func TestLogLevelSummary(t *testing.T) {
+	dir := pagesDir(t, map[string]string{
+		"a.html": `<html><body><h1 id="title-text"><a href="/a">A</a></h1><div id="main-content">text</div></body></html>`,
+	})
+	defer os.RemoveAll(dir)
+	_, stderr, err := runMain(t, "-input", dir, "-log-level", "warn")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if stderr != "" {
+		t.Errorf("got %q with -log-level warn, want nothing", stderr)
+	}
+	_, stderr, err = runMain(t, "-input", dir, "-log-level", "info")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if !strings.Contains(stderr, "info: 1 pages extracted") {
+		t.Errorf("got %q with -log-level info, want the summary", stderr)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	dir := pagesDir(t, map[string]string{
+		"a.html":   `<html><body><h1 id="title-text"><a href="/a">A</a></h1><div id="main-content">text</div></body></html>`,
+		"bad.html": `<html><body><div class="page-metadata-modification-info"><span class="last-modified">sometime</span></div></body></html>`,
+	})
+	defer os.RemoveAll(dir)
+	stdout, stderr, err := runMain(t, "-input", dir, "-log-level", "info")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if strings.Count(stdout, "\n") != 1 {
+		t.Errorf("got records %q, want the one of A", stdout)
+	}
+	if !strings.Contains(stderr, "info: 1 pages extracted, 0 could not be read, 1 could not be extracted, 0 images unavailable") {
+		t.Errorf("got %q, want the summary of one page extracted and one failed", stderr)
+	}
+}
+
+// indexFile writes an index of the subpages at urls and returns its name.
+func indexFile(t *testing.T, dir string, urls ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<html><body><div id="page-children">`)
+	for _, url := range urls {
+		fmt.Fprintf(&buf, `<a href="%s">%s</a>`, url, url)
+	}
+	buf.WriteString(`</div></body></html>`)
+	name := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestProxy(t *testing.T) {
+	var (
+		mux   sync.Mutex
+		hosts []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		hosts = append(hosts, r.URL.Host)
+		mux.Unlock()
+		fmt.Fprint(w, `<html><body><h1 id="title-text"><a href="/x">Proxied</a></h1><div id="main-content">text</div></body></html>`)
+	}))
+	defer proxy.Close()
+	dir := pagesDir(t, nil)
+	defer os.RemoveAll(dir)
+	index := indexFile(t, dir, "http://wiki.invalid/display/X/Page")
+	for _, env := range [][]string{nil, {"HTTP_PROXY=" + proxy.URL, "NO_PROXY="}} {
+		args := []string{"-input", index, "-domain", "http://wiki.invalid", "-log-level", "error", "-retries", "0"}
+		if env == nil {
+			args = append(args, "-proxy", proxy.URL)
+		}
+		stdout, stderr, err := runMainEnv(t, env, args...)
+		if err != nil {
+			t.Fatalf("%s: %s", err, stderr)
+		}
+		if !strings.Contains(stdout, `"text":"Proxied"`) {
+			t.Errorf("proxy env %q: got %q, want the page served by the proxy", env, stdout)
+		}
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(hosts) != 2 || hosts[0] != "wiki.invalid" || hosts[1] != "wiki.invalid" {
+		t.Errorf("got requests for %q through the proxy, want two for wiki.invalid", hosts)
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body><h1 id="title-text"><a href="/x">Secure</a></h1><div id="main-content">text</div></body></html>`)
+	}))
+	defer srv.Close()
+	dir := pagesDir(t, nil)
+	defer os.RemoveAll(dir)
+	index := indexFile(t, dir, srv.URL+"/display/X/Page")
+	args := []string{"-input", index, "-domain", srv.URL, "-log-level", "info", "-retries", "0"}
+	// The certificate of the test server is not trusted
+	stdout, stderr, err := runMain(t, args...)
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if stdout != "" || !strings.Contains(stderr, "1 could not be read") {
+		t.Errorf("got %q, want the page not read: %s", stdout, stderr)
+	}
+	stdout, stderr, err = runMain(t, append(args, "-insecure")...)
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if !strings.Contains(stdout, `"text":"Secure"`) || !strings.Contains(stderr, "warning: TLS certificates are not verified") {
+		t.Errorf("got %q, want the page with -insecure: %s", stdout, stderr)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer srv.Close()
+	dir := pagesDir(t, nil)
+	defer os.RemoveAll(dir)
+	// Excluded and duplicate pages are left out like when extracting
+	index := indexFile(t, dir, "/display/X/A", "/display/X/Draft", "/display/X/B", "/display/X/A#history", "/display/X/B/")
+	stdout, stderr, err := runMain(t, "-input", index, "-domain", srv.URL, "-dry-run", "-exclude", "/Draft$")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if want := srv.URL + "/display/X/A\n" + srv.URL + "/display/X/B\n"; stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+	if n := atomic.LoadInt64(&hits); n != 0 {
+		t.Errorf("got %d requests, want none", n)
+	}
+}
+
+func TestEmitFiles(t *testing.T) {
+	dir := pagesDir(t, nil)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.html", "sub/b.HTML", ".hidden/c.html", ".d.html", "notes.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("<html></html>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := make(chan string, 10)
+	if err := emitFiles(context.Background(), dir, out); err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for url := range out {
+		urls = append(urls, url)
+	}
+	want := []string{"file://" + filepath.Join(dir, "a.html"), "file://" + filepath.Join(dir, "sub", "b.HTML")}
+	if strings.Join(urls, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", urls, want)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		fmt.Fprintf(w, `<html><body><h1 id="title-text"><a href="%s">%s</a></h1></body></html>`, r.URL.Path, r.URL.Path)
+	}))
+	defer srv.Close()
+	defer close(release)
+	dir := pagesDir(t, nil)
+	defer os.RemoveAll(dir)
+	index := indexFile(t, dir, "/display/X/A", "/display/X/B")
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "WIKI_EXTRACT_ARGS="+strings.Join([]string{"-input", index, "-domain", srv.URL, "-workers", "1"}, "\n"))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The page in progress is still written out, the next one not started
+	<-started
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	release <- struct{}{}
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("got no error, want exit status 1 when interrupted")
+	}
+	if out := stdout.String(); strings.Count(out, "\n") != 1 || !strings.Contains(out, `"text":"/display/X/A"`) {
+		t.Errorf("got %q, want only the record of A", out)
+	}
+	if !strings.Contains(stderr.String(), "warning: interrupted") {
+		t.Errorf("got %q, want the interruption logged", stderr.String())
+	}
+}
+
+func TestHeaderFlag(t *testing.T) {
+	h := headerFlag(make(http.Header))
+	for _, s := range []string{"X-Token: abc", "Accept-Language:de", "X-Token: def"} {
+		if err := h.Set(s); err != nil {
+			t.Errorf("%q: %s", s, err)
+		}
+	}
+	if got := http.Header(h)["X-Token"]; len(got) != 2 || got[0] != "abc" || got[1] != "def" {
+		t.Errorf("got X-Token %q, want abc and def", got)
+	}
+	if got := http.Header(h).Get("Accept-Language"); got != "de" {
+		t.Errorf("got Accept-Language %q, want de", got)
+	}
+	for _, s := range []string{"X-Token abc", ": abc", "X Token: abc"} {
+		if err := h.Set(s); err == nil {
+			t.Errorf("%q: got no error", s)
+		}
+	}
+
+	var tokens sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens.Store(r.Header.Get("X-Token"), true)
+		fmt.Fprint(w, `<html><body><h1 id="title-text"><a href="/a">A</a></h1></body></html>`)
+	}))
+	defer srv.Close()
+	dir := pagesDir(t, nil)
+	defer os.RemoveAll(dir)
+	index := indexFile(t, dir, "/display/X/A")
+	_, stderr, err := runMain(t, "-input", index, "-domain", srv.URL, "-header", "X-Token: abc")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if _, ok := tokens.Load("abc"); !ok {
+		t.Errorf("header not sent with the page request")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tests := []struct{ maxIdle, perHost, total int }{
+		{4, 4, 100},
+		{200, 200, 200},
+	}
+	for _, tt := range tests {
+		tr := newTransport(tt.maxIdle, time.Second, time.Minute)
+		if tr.MaxIdleConnsPerHost != tt.perHost || tr.MaxIdleConns != tt.total {
+			t.Errorf("%d: got %d idle connections per host and %d in total, want %d and %d",
+				tt.maxIdle, tr.MaxIdleConnsPerHost, tr.MaxIdleConns, tt.perHost, tt.total)
+		}
+	}
+}
+
+func TestIdleConns(t *testing.T) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		fmt.Fprintf(w, `<html><body><h1 id="title-text"><a href="%s">%s</a></h1></body></html>`, r.URL.Path, r.URL.Path)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	dir := pagesDir(t, nil)
+	defer os.RemoveAll(dir)
+	var urls []string
+	for n := 0; n < 60; n++ {
+		urls = append(urls, fmt.Sprintf("/display/X/P%d", n))
+	}
+	index := indexFile(t, dir, urls...)
+	// The connections of all workers are kept open between pages
+	_, stderr, err := runMain(t, "-input", index, "-domain", srv.URL, "-workers", "6", "-log-level", "error")
+	if err != nil {
+		t.Fatalf("%s: %s", err, stderr)
+	}
+	if n := atomic.LoadInt64(&conns); n > 6 {
+		t.Errorf("got %d connections, want at most one for each worker", n)
+	}
+}
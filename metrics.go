@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/dullgiulio/wiki-extract-mdata/extract"
+)
+
+// metrics serves the counters of a run in the Prometheus text format.
+type metrics struct {
+	processor *extract.Processor
+	client    *extract.Client
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	stats := m.processor.Stats()
+	images := m.processor.Images
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"wiki_pages_processed_total", "Pages extracted.", stats.Processed},
+		{"wiki_pages_failed_total", "Pages that could not be read or extracted.", stats.ReadFailed + stats.ExtractFailed},
+		{"wiki_images_fetched_total", "Images downloaded from the wiki.", images.Downloaded()},
+		{"wiki_image_cache_hits_total", "Images found in the memory cache.", images.CacheHits()},
+		{"wiki_image_cache_misses_total", "Images not found in the memory cache.", images.CacheMisses()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+	if m.client.Latency != nil {
+		m.client.Latency.WritePrometheus(bw, "wiki_fetch_duration_seconds", "Duration of the requests to the wiki.")
+	}
+	if err := bw.Flush(); err != nil {
+		log.Printf("warning: cannot write metrics: %s", err)
+	}
+}
+
+// serveMetrics serves the metrics on /metrics at addr in the background.
+func serveMetrics(addr string, m *metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			log.Printf("error: cannot serve metrics: %s", err)
+		}
+	}()
+}
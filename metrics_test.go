@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dullgiulio/wiki-extract-mdata/extract"
+)
+
+func TestMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(append([]byte("GIF89a"), make([]byte, 64)...))
+	}))
+	defer srv.Close()
+	client := &extract.Client{HTTP: http.DefaultClient, Latency: extract.NewHistogram(extract.DefaultLatencyBuckets)}
+	p := extract.NewProcessor(srv.URL)
+	p.Client = client
+	p.Images = extract.NewImageProc(1, 16, client, extract.NewImageFilter(0, 0, nil))
+	page := `<html><body><div id="main-content"><table class="confluenceTable">
+<tr><th>Logo</th><td><img src="/logo.gif"></td></tr></table></div></body></html>`
+	// The image is prefetched and then rendered, it is fetched once
+	if _, err := p.Extract(context.Background(), strings.NewReader(page)); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	(&metrics{processor: p, client: client}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"wiki_images_fetched_total 1\n",
+		"# TYPE wiki_image_cache_misses_total counter\n",
+		"wiki_fetch_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("got\n%s\nwant a line %q", body, line)
+		}
+	}
+	if n := p.Images.CacheHits() + p.Images.CacheMisses(); n != 1 {
+		t.Errorf("got %d cache hits and misses, want 1 for the rendered image", n)
+	}
+}
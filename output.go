@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/dullgiulio/wiki-extract-mdata/extract"
+	"gopkg.in/yaml.v3"
+)
+
+// pageFields are the record fields available to the filename template.
+type pageFields struct {
+	Title string
+	// Slug of the title, or Hash if the page has no title
+	TitleSlug string
+	// Short hash of the record
+	Hash     string
+	URL      string
+	SpaceKey string
+	PageID   string
+	Author   string
+	Date     string
+}
+
+func newPageFields(data []byte) (*pageFields, error) {
+	var vals struct {
+		Title struct {
+			Text string `json:"text"`
+			URL  string `json:"url"`
+		} `json:"_title"`
+		Author struct {
+			Name string `json:"name"`
+		} `json:"_author"`
+		Date string `json:"_date"`
+	}
+	if err := json.Unmarshal(data, &vals); err != nil {
+		return nil, fmt.Errorf("cannot parse record: %s", err)
+	}
+	f := &pageFields{
+		Title:     vals.Title.Text,
+		TitleSlug: extract.Slug(vals.Title.Text),
+		URL:       vals.Title.URL,
+		Author:    vals.Author.Name,
+		Date:      vals.Date,
+	}
+	sum := sha256.Sum256(data)
+	f.Hash = hex.EncodeToString(sum[:6])
+	if f.TitleSlug == "" {
+		f.TitleSlug = f.Hash
+	}
+	if u, err := url.Parse(vals.Title.URL); err == nil {
+		f.PageID = u.Query().Get("pageId")
+		// Confluence page URLs look like /display/SPACE/Title or /spaces/SPACE/...
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		for n := 0; n < len(parts)-1; n++ {
+			if parts[n] == "display" || parts[n] == "spaces" {
+				f.SpaceKey = parts[n+1]
+				break
+			}
+		}
+	}
+	return f, nil
+}
+
+// safeRune replaces the characters not allowed in filenames.
+func safeRune(r rune) rune {
+	if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+		return '-'
+	}
+	return r
+}
+
+// sanitize makes the fields safe to use in filenames, so that only the
+// slashes of the template separate directories.
+func (f *pageFields) sanitize() {
+	for _, s := range []*string{&f.Title, &f.TitleSlug, &f.Hash, &f.URL, &f.SpaceKey, &f.PageID, &f.Author, &f.Date} {
+		*s = strings.Map(safeRune, *s)
+	}
+}
+
+// sanitizeComponent makes s safe to use as a single path component.
+func sanitizeComponent(s string) (string, error) {
+	s = strings.Map(safeRune, s)
+	s = strings.Trim(s, " .")
+	if s == "" {
+		return "", fmt.Errorf("empty path component")
+	}
+	return s, nil
+}
+
+// fileWriter writes each record to its own file under dir.
+type fileWriter struct {
+	dir  string
+	tmpl *template.Template
+	// Number of records written to each filename
+	used map[string]int
+}
+
+func newFileWriter(dir, tmpl string) (*fileWriter, error) {
+	t, err := template.New("filename").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse filename template: %s", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create output directory: %s", err)
+	}
+	return &fileWriter{dir: dir, tmpl: t, used: make(map[string]int)}, nil
+}
+
+func (f *fileWriter) filename(data []byte) (string, error) {
+	fields, err := newPageFields(data)
+	if err != nil {
+		return "", err
+	}
+	fields.sanitize()
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, fields); err != nil {
+		return "", fmt.Errorf("cannot execute filename template: %s", err)
+	}
+	parts := strings.Split(buf.String(), "/")
+	for n := range parts {
+		if parts[n], err = sanitizeComponent(parts[n]); err != nil {
+			return "", fmt.Errorf("invalid filename %q: %s", buf.String(), err)
+		}
+	}
+	return f.unique(filepath.Join(append([]string{f.dir}, parts...)...)), nil
+}
+
+// unique returns name, or name with a counter before the extension if
+// another record of this run was written to name.
+func (f *fileWriter) unique(name string) string {
+	f.used[name]++
+	n := f.used[name]
+	if n == 1 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	alt := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+	// The alternative might be taken by a page with that title
+	if _, ok := f.used[alt]; ok {
+		return f.unique(name)
+	}
+	f.used[alt] = 1
+	log.Printf("warning: %s already written, using %s", name, alt)
+	return alt
+}
+
+func (f *fileWriter) write(data []byte) error {
+	name, err := f.filename(data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %s", err)
+	}
+	if err := ioutil.WriteFile(name, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write file: %s", err)
+	}
+	return nil
+}
+
+// filePrinter writes each record to its own file. Records that cannot be
+// written are skipped and the first error is reported on done.
+func filePrinter(in <-chan []byte, f *fileWriter, done chan<- error) {
+	var first error
+	for data := range in {
+		if err := f.write(data); err != nil {
+			log.Printf("error: cannot write record: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	done <- first
+}
+
+// flatten stores v in row, naming the columns of nested objects after their
+// parent key. Lists of plain values are joined one item per line, the items
+// of other lists are named after their index, like breadcrumbs_0_text.
+func flatten(key string, v interface{}, row map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			flatten(key+"_"+k, sub, row)
+		}
+	case []interface{}:
+		if !plainList(v) {
+			for i, item := range v {
+				flatten(fmt.Sprintf("%s_%d", key, i), item, row)
+			}
+			return
+		}
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			sub := make(map[string]string)
+			flatten("", item, sub)
+			items = append(items, sub[""])
+		}
+		row[key] = strings.Join(items, "\n")
+	case string:
+		row[key] = v
+	case nil:
+		row[key] = ""
+	default:
+		row[key] = fmt.Sprint(v)
+	}
+}
+
+// plainList reports whether no item of list is an object or a list.
+func plainList(list []interface{}) bool {
+	for _, item := range list {
+		switch item.(type) {
+		case map[string]interface{}, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+// csvColumns returns the metadata columns followed by the table keys, each sorted.
+func csvColumns(columns map[string]bool) []string {
+	var meta, keys []string
+	for c, isMeta := range columns {
+		if isMeta {
+			meta = append(meta, c)
+		} else {
+			keys = append(keys, c)
+		}
+	}
+	sort.Strings(meta)
+	sort.Strings(keys)
+	return append(meta, keys...)
+}
+
+// csvPrinter buffers all records to write them as CSV with a column for each
+// key found in any record.
+func csvPrinter(in <-chan []byte, w io.Writer, done chan<- error) {
+	var rows []map[string]string
+	// Column names, true for page metadata
+	columns := make(map[string]bool)
+	for data := range in {
+		var vals map[string]interface{}
+		if err := json.Unmarshal(data, &vals); err != nil {
+			log.Printf("error: cannot parse record: %s", err)
+			continue
+		}
+		meta := make(map[string]string)
+		row := make(map[string]string)
+		for k, v := range vals {
+			if strings.HasPrefix(k, "_") {
+				flatten(strings.TrimPrefix(k, "_"), v, meta)
+				continue
+			}
+			flatten(k, v, row)
+		}
+		for k := range row {
+			if _, ok := columns[k]; !ok {
+				columns[k] = false
+			}
+		}
+		for k, v := range meta {
+			columns[k] = true
+			row[k] = v
+		}
+		rows = append(rows, row)
+	}
+	header := csvColumns(columns)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		done <- err
+		return
+	}
+	record := make([]string, len(header))
+	for _, row := range rows {
+		for n, c := range header {
+			record[n] = row[c]
+		}
+		if err := cw.Write(record); err != nil {
+			done <- err
+			return
+		}
+	}
+	cw.Flush()
+	done <- cw.Error()
+}
+
+// blockStyle makes node and its children use the YAML block style, instead of
+// the flow style of the JSON they were parsed from.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, c := range node.Content {
+		blockStyle(c)
+	}
+}
+
+// yamlPrinter writes each record as a YAML document, keeping the order of the keys.
+// After the first write error it keeps draining in and reports that error on done.
+func yamlPrinter(in <-chan []byte, w io.Writer, done chan<- error) {
+	bw := bufio.NewWriter(w)
+	enc := yaml.NewEncoder(bw)
+	enc.SetIndent(2)
+	var err error
+	for data := range in {
+		if err != nil {
+			continue
+		}
+		// JSON is YAML: parsing it to a node keeps the order of the keys
+		var doc yaml.Node
+		if e := yaml.Unmarshal(data, &doc); e != nil {
+			log.Printf("error: cannot parse record: %s", e)
+			continue
+		}
+		blockStyle(&doc)
+		err = enc.Encode(&doc)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	done <- err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// csvRows returns the records printed as CSV by column name.
+func csvRows(t *testing.T, records ...string) []map[string]string {
+	in := make(chan []byte, len(records))
+	for _, rec := range records {
+		in <- []byte(rec)
+	}
+	close(in)
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	csvPrinter(in, &buf, done)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	lines, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []map[string]string
+	for _, line := range lines[1:] {
+		row := make(map[string]string)
+		for i, c := range lines[0] {
+			row[c] = line[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestCSVColumns(t *testing.T) {
+	in := make(chan []byte, 2)
+	in <- []byte(`{"_title": {"text": "A", "url": "/a"}, "Status": "done", "Owner": "alice"}`)
+	in <- []byte(`{"_date": "2019-02-05T10:00:00Z", "Cost": 12}`)
+	close(in)
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	csvPrinter(in, &buf, done)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	lines, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Page metadata first, then the keys of all records, each sorted
+	want := [][]string{
+		{"date", "title_text", "title_url", "Cost", "Owner", "Status"},
+		{"", "A", "/a", "", "alice", "done"},
+		{"2019-02-05T10:00:00Z", "", "", "12", "", ""},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i := range want {
+		if strings.Join(lines[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("line %d: got %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestCSVBreadcrumbs(t *testing.T) {
+	rows := csvRows(t, `{"_breadcrumbs": [{"text": "Home", "url": "http://wiki.local/display/X"},
+		{"text": "Team", "url": "http://wiki.local/display/X/Team"}], "Owners": ["alice", "bob"]}`)
+	want := map[string]string{
+		"breadcrumbs_0_text": "Home",
+		"breadcrumbs_0_url":  "http://wiki.local/display/X",
+		"breadcrumbs_1_text": "Team",
+		"breadcrumbs_1_url":  "http://wiki.local/display/X/Team",
+		"Owners":             "alice\nbob",
+	}
+	for c, v := range want {
+		if rows[0][c] != v {
+			t.Errorf("got %s %q, want %q", c, rows[0][c], v)
+		}
+	}
+}
+
+func TestCSVAttachments(t *testing.T) {
+	rows := csvRows(t, `{"_attachments": [{"name": "a.pdf", "url": "http://wiki.local/download/a.pdf", "size": "12 kB"},
+		{"name": "b.png", "url": "http://wiki.local/download/b.png"}]}`)
+	want := map[string]string{
+		"attachments_0_name": "a.pdf",
+		"attachments_0_url":  "http://wiki.local/download/a.pdf",
+		"attachments_0_size": "12 kB",
+		"attachments_1_name": "b.png",
+		"attachments_1_url":  "http://wiki.local/download/b.png",
+	}
+	for c, v := range want {
+		if got, ok := rows[0][c]; !ok || got != v {
+			t.Errorf("got %s %q, want %q", c, got, v)
+		}
+	}
+}
+
+// writeFiles writes records with filePrinter and returns the files written
+// under dir and the error reported.
+func writeFiles(t *testing.T, dir, tmpl string, records ...string) ([]string, error) {
+	fw, err := newFileWriter(dir, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan []byte, len(records))
+	for _, rec := range records {
+		in <- []byte(rec)
+	}
+	close(in)
+	done := make(chan error, 1)
+	filePrinter(in, fw, done)
+	err = <-done
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+func TestFilenameFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files, err := writeFiles(t, dir, "{{.SpaceKey}}/{{.Title}}.json",
+		`{"_title": {"text": "Input/Output", "url": "http://wiki.local/display/TEAM/Input"}}`,
+		`{"_title": {"text": "../../escape", "url": "http://wiki.local/display/TEAM/Escape"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"TEAM/-..-escape.json", "TEAM/Input-Output.json"}
+	sort.Strings(files)
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("got files %v, want %v", files, want)
+	}
+}
+
+func TestFilenameCollisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The counter of the second Page must skip the page titled Page-2
+	files, err := writeFiles(t, dir, "{{.Title}}.json",
+		`{"_title": {"text": "Page-2"}}`, `{"_title": {"text": "Page"}}`, `{"_title": {"text": "Page"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Page-2.json", "Page-3.json", "Page.json"}
+	sort.Strings(files)
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("got files %v, want %v", files, want)
+	}
+}
+
+func TestFilenameHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Pages without a title are named after the hash of their record
+	files, err := writeFiles(t, dir, "{{.TitleSlug}}.json", `{"Owner": "alice"}`, `{"Owner": "bob"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] == files[1] {
+		t.Fatalf("got files %v, want two named after their hash", files)
+	}
+	for _, name := range files {
+		if len(name) != len("0123456789ab.json") || strings.Contains(name, "-") {
+			t.Errorf("got file %s, want a hash of 12 digits", name)
+		}
+	}
+}
+
+func TestFilePrinterError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files, err := writeFiles(t, dir, "{{.TitleSlug}}.json",
+		`{"_title": {"text": "Page"}}`, `not JSON`)
+	if err == nil {
+		t.Error("expected the error of the invalid record")
+	}
+	if len(files) != 1 {
+		t.Errorf("got files %v, want the valid record written", files)
+	}
+}
+
+func TestYAMLPrinter(t *testing.T) {
+	in := make(chan []byte, 2)
+	in <- []byte(`{"_title": {"text": "A", "url": "/a"}, "Status": "done", "Owners": ["alice", "bob"]}`)
+	in <- []byte(`{"Zeta": "1", "Alpha": "2"}`)
+	close(in)
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	yamlPrinter(in, &buf, done)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// One document each, in block style and with the keys in their order
+	want := `_title:
+  text: A
+  url: /a
+Status: done
+Owners:
+  - alice
+  - bob
+---
+Zeta: "1"
+Alpha: "2"
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}